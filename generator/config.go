@@ -0,0 +1,218 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+
+	"github.com/Wessie/fingerprinter/storage"
+)
+
+// Window is a window function applied to every frame before the FFT
+type Window int
+
+const (
+	Hamming Window = iota
+	Hann
+	Rectangular
+)
+
+func (w Window) String() string {
+	switch w {
+	case Hamming:
+		return "hamming"
+	case Hann:
+		return "hann"
+	case Rectangular:
+		return "rectangular"
+	}
+	return "window(" + strconv.Itoa(int(w)) + ")"
+}
+
+// Coefficients returns the window coefficients for a window of size n
+func (w Window) Coefficients(n int) []float64 {
+	coeffs := make([]float64, n)
+	for i := range coeffs {
+		switch w {
+		case Hamming:
+			coeffs[i] = 0.54 - 0.46*math.Cos(2*math.Pi*float64(i)/(float64(n)-1))
+		case Hann:
+			coeffs[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/(float64(n)-1))
+		default:
+			coeffs[i] = 1
+		}
+	}
+	return coeffs
+}
+
+// SpectrogramConfig holds the parameters used to turn audio into a spectrogram
+type SpectrogramConfig struct {
+	// WindowSize is the amount of samples in each frame, must be a power of two
+	WindowSize int
+	// HopSize is the amount of samples between the start of two frames
+	HopSize int
+	// Window is the window function applied to each frame
+	Window Window
+	// SampleRate is the sample rate the audio is resampled to before the STFT
+	SampleRate int
+	// Cutoff is the highest frequency in Hz passed by the resampling filter
+	Cutoff float64
+}
+
+// DefaultSpectrogramConfig is the configuration used when none is given
+var DefaultSpectrogramConfig = SpectrogramConfig{
+	WindowSize: 1024,
+	HopSize:    1024 / 32,
+	Window:     Hamming,
+	SampleRate: 11025,
+	Cutoff:     5000, // 5kHz
+}
+
+// Validate checks if the configuration can be used
+func (c SpectrogramConfig) Validate() error {
+	if c.WindowSize <= 0 || c.WindowSize&(c.WindowSize-1) != 0 {
+		return fmt.Errorf("window size must be a power of two, got %d", c.WindowSize)
+	}
+	if c.HopSize <= 0 || c.HopSize > c.WindowSize {
+		return fmt.Errorf("hop size must be between 1 and the window size, got %d", c.HopSize)
+	}
+	if c.SampleRate <= 0 {
+		return errors.New("sample rate must be positive")
+	}
+	if c.Cutoff <= 0 || c.Cutoff > float64(c.SampleRate)/2 {
+		return fmt.Errorf("cutoff must be between 0 and the nyquist frequency, got %v", c.Cutoff)
+	}
+	return nil
+}
+
+// FrameCount returns the amount of frames in the spectrogram of a signal that
+// is n samples long at the configured sample rate, only full windows are
+// counted.
+func (c SpectrogramConfig) FrameCount(n int) int {
+	if n < c.WindowSize {
+		return 0
+	}
+	return (n-c.WindowSize)/c.HopSize + 1
+}
+
+// FrameDuration returns the time between the start of two frames in seconds
+func (c SpectrogramConfig) FrameDuration() float64 {
+	return float64(c.HopSize) / float64(c.SampleRate)
+}
+
+// stftRevision is bumped whenever the processing done by STFT changes in a way
+// that changes its output for the same configuration
+const stftRevision = 2
+
+// Version returns a number identifying this configuration, fingerprints
+// generated with configurations that have a different version are not
+// comparable.
+func (c SpectrogramConfig) Version() uint32 {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "stft:%d:%d:%d:%s:%d:%g", stftRevision, c.WindowSize, c.HopSize, c.Window, c.SampleRate, c.Cutoff)
+	return h.Sum32()
+}
+
+// Spectrogram computes the spectrogram of samples recorded at sampleRate
+func (c SpectrogramConfig) Spectrogram(samples []float64, sampleRate int) ([][]complex128, error) {
+	var spectrogram [][]complex128
+
+	stft, err := NewSTFT(c, sampleRate, func(_ int, frame []complex128) error {
+		spectrogram = append(spectrogram, frame)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = stft.Write(samples); err != nil {
+		return nil, err
+	}
+	if err = stft.Flush(); err != nil {
+		return nil, err
+	}
+
+	return spectrogram, nil
+}
+
+// spectrogramVersionKey and peakExtractorKey are the storage settings the
+// spectrogram configuration version and the peak extractor are recorded under
+const (
+	spectrogramVersionKey = "spectrogram_version"
+	peakExtractorKey      = "peak_extractor"
+)
+
+// ErrVersionMismatch is returned when the fingerprints in storage were
+// generated with a different configuration than the one in use
+var ErrVersionMismatch = errors.New("fingerprint configuration version mismatch")
+
+// CheckVersion makes sure the fingerprints in db were generated with the same
+// configuration as cfg and the same peak extractor as peaks. If db has no
+// versions recorded yet they are set to the ones given, but only if it has no
+// songs, the songs of older databases have to be reindexed.
+func CheckVersion(db storage.Storage, cfg SpectrogramConfig, peaks PeakExtractor) error {
+	return checkVersion(db, cfg, peaks, true)
+}
+
+// checkVersion is CheckVersion, it only records missing versions if record is
+// true
+func checkVersion(db storage.Storage, cfg SpectrogramConfig, peaks PeakExtractor, record bool) error {
+	err := checkSetting(db, spectrogramVersionKey, strconv.FormatUint(uint64(cfg.Version()), 10), record)
+	if err != nil {
+		return err
+	}
+	return checkSetting(db, peakExtractorKey, peakExtractorVersion(peaks), record)
+}
+
+// RecordVersion records the versions of cfg and peaks in db no matter what was
+// recorded before, this is only correct if every song is fingerprinted again
+func RecordVersion(db storage.Storage, cfg SpectrogramConfig, peaks PeakExtractor) error {
+	err := db.SetSetting(spectrogramVersionKey, strconv.FormatUint(uint64(cfg.Version()), 10))
+	if err != nil {
+		return err
+	}
+	return db.SetSetting(peakExtractorKey, peakExtractorVersion(peaks))
+}
+
+// peakExtractorVersion identifies a peak extractor and its parameters
+func peakExtractorVersion(peaks PeakExtractor) string {
+	return fmt.Sprintf("%T%+v", peaks, peaks)
+}
+
+// checkSetting compares the setting key in db with want, if it is missing it
+// is set to want if record is true
+func checkSetting(db storage.Storage, key, want string, record bool) error {
+	have, ok, err := db.GetSetting(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if err := checkUnrecorded(db, key); err != nil || !record {
+			return err
+		}
+		return db.SetSetting(key, want)
+	}
+	if have != want {
+		return fmt.Errorf("%w: %s is %s in storage but %s is in use, the songs have to be reindexed",
+			ErrVersionMismatch, key, have, want)
+	}
+	return nil
+}
+
+// checkUnrecorded returns an error if db has songs even though the setting key
+// isn't recorded
+func checkUnrecorded(db storage.Storage, key string) error {
+	// fingerprints are always stored for a song, so without songs there is
+	// nothing the version could be wrong for
+	songs, err := db.ListSongs(0, 1)
+	if err != nil {
+		return err
+	}
+	if len(songs) > 0 {
+		return fmt.Errorf("%w: %s is not recorded in storage, its songs were fingerprinted by an older version and have to be reindexed",
+			ErrVersionMismatch, key)
+	}
+	return nil
+}
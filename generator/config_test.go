@@ -0,0 +1,60 @@
+package generator
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Wessie/fingerprinter/storage"
+)
+
+func TestCheckVersionRecordsOnEmptyStorage(t *testing.T) {
+	db := storage.NewMemoryStorage()
+
+	if err := CheckVersion(db, DefaultSpectrogramConfig, BandPeakExtractor{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{spectrogramVersionKey, peakExtractorKey} {
+		if _, ok, err := db.GetSetting(key); err != nil || !ok {
+			t.Errorf("%s was not recorded: %v", key, err)
+		}
+	}
+
+	// the recorded versions are checked from then on
+	if err := CheckVersion(db, DefaultSpectrogramConfig, BandPeakExtractor{}); err != nil {
+		t.Errorf("same versions: %v", err)
+	}
+
+	other := DefaultSpectrogramConfig
+	other.HopSize *= 2
+	if err := CheckVersion(db, other, BandPeakExtractor{}); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("other config: got %v, want ErrVersionMismatch", err)
+	}
+	if err := CheckVersion(db, DefaultSpectrogramConfig, DefaultConstellationPeakExtractor); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("other peak extractor: got %v, want ErrVersionMismatch", err)
+	}
+}
+
+func TestCheckVersionRejectsUnrecordedSongs(t *testing.T) {
+	// a database from before versions were recorded, it has songs but no
+	// settings
+	db := storage.NewMemoryStorage()
+	if _, err := db.RegisterSong("key", "song"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := CheckVersion(db, DefaultSpectrogramConfig, BandPeakExtractor{})
+	if !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("got %v, want ErrVersionMismatch", err)
+	}
+	if _, ok, _ := db.GetSetting(spectrogramVersionKey); ok {
+		t.Error("the version was recorded anyway")
+	}
+
+	// until the songs are reindexed
+	if err := RecordVersion(db, DefaultSpectrogramConfig, BandPeakExtractor{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckVersion(db, DefaultSpectrogramConfig, BandPeakExtractor{}); err != nil {
+		t.Errorf("after RecordVersion: %v", err)
+	}
+}
@@ -1,45 +1,171 @@
 package generator
 
 import (
+	"fmt"
 	"math"
+	"math/bits"
+	"sync"
 )
 
-// Fft performs the Fast Fourier Transform on the input signal.
+// FFT performs the Fast Fourier Transform on the input signal, the length of
+// the input has to be a power of two.
 func FFT(input []float64) []complex128 {
-	// Convert input to complex128
-	complexArray := make([]complex128, len(input))
+	plan, err := NewFFTPlan(len(input))
+	if err != nil {
+		panic(err)
+	}
+
+	fftResult := make([]complex128, len(input))
 	for i, v := range input {
-		complexArray[i] = complex(v, 0)
+		fftResult[i] = complex(v, 0)
 	}
+	plan.Transform(fftResult)
+	return fftResult
+}
+
+// fftPlans caches plans by their size
+var fftPlans sync.Map // int -> *FFTPlan
 
-	fftResult := make([]complex128, len(complexArray))
-	copy(fftResult, complexArray) // Copy input to result buffer
-	return recursiveFFT(fftResult)
+// FFTPlan holds the precomputed tables for transforms of a single size, a plan
+// is never modified after creation and is safe to use from many goroutines.
+type FFTPlan struct {
+	n int
+	// twiddle holds exp(-2πik/n) for k in [0, n/2]
+	twiddle []complex128
+	// rev is the bit-reversal permutation for a transform of size n
+	rev []int
+	// halfRev is the bit-reversal permutation for a transform of size n/2,
+	// this is used by Real
+	halfRev []int
 }
 
-// recursiveFFT performs the recursive FFT algorithm.
-func recursiveFFT(complexArray []complex128) []complex128 {
-	N := len(complexArray)
-	if N <= 1 {
-		return complexArray
+// NewFFTPlan returns a plan for transforms of size n, n has to be a power of
+// two. Plans are cached so calling this repeatedly with the same size is cheap.
+func NewFFTPlan(n int) (*FFTPlan, error) {
+	if p, ok := fftPlans.Load(n); ok {
+		return p.(*FFTPlan), nil
+	}
+	if n <= 0 || n&(n-1) != 0 {
+		return nil, fmt.Errorf("fft size must be a power of two, got %d", n)
 	}
 
-	even := make([]complex128, N/2)
-	odd := make([]complex128, N/2)
-	for i := 0; i < N/2; i++ {
-		even[i] = complexArray[2*i]
-		odd[i] = complexArray[2*i+1]
+	p := &FFTPlan{
+		n:       n,
+		twiddle: make([]complex128, n/2+1),
+		rev:     bitReversal(n),
+		halfRev: bitReversal(n / 2),
+	}
+	for k := range p.twiddle {
+		angle := -2 * math.Pi * float64(k) / float64(n)
+		p.twiddle[k] = complex(math.Cos(angle), math.Sin(angle))
 	}
 
-	even = recursiveFFT(even)
-	odd = recursiveFFT(odd)
+	actual, _ := fftPlans.LoadOrStore(n, p)
+	return actual.(*FFTPlan), nil
+}
 
-	fftResult := make([]complex128, N)
-	for k := 0; k < N/2; k++ {
-		t := complex(math.Cos(-2*math.Pi*float64(k)/float64(N)), math.Sin(-2*math.Pi*float64(k)/float64(N)))
-		fftResult[k] = even[k] + t*odd[k]
-		fftResult[k+N/2] = even[k] - t*odd[k]
+// bitReversal returns the bit-reversal permutation of size n
+func bitReversal(n int) []int {
+	if n <= 1 {
+		return []int{0}
+	}
+	shift := bits.UintSize - bits.Len(uint(n-1))
+	rev := make([]int, n)
+	for i := range rev {
+		rev[i] = int(bits.Reverse(uint(i)) >> shift)
 	}
+	return rev
+}
 
-	return fftResult
+// Size returns the size of transforms this plan is for
+func (p *FFTPlan) Size() int {
+	return p.n
+}
+
+// Transform performs an in-place forward FFT of data, data has to be exactly
+// Size() long.
+func (p *FFTPlan) Transform(data []complex128) {
+	if len(data) != p.n {
+		panic(fmt.Sprintf("fft: data length %d does not match plan size %d", len(data), p.n))
+	}
+	p.transform(data, p.rev)
+}
+
+// transform performs an iterative radix-2 FFT of data, len(data) can be any
+// power of two that divides the plan size
+func (p *FFTPlan) transform(data []complex128, rev []int) {
+	n := len(data)
+	for i, j := range rev {
+		if i < j {
+			data[i], data[j] = data[j], data[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		half := size / 2
+		// twiddle index step for exp(-2πij/size)
+		step := p.n / size
+		for start := 0; start < n; start += size {
+			for j := 0; j < half; j++ {
+				t := p.twiddle[j*step] * data[start+j+half]
+				u := data[start+j]
+				data[start+j] = u + t
+				data[start+j+half] = u - t
+			}
+		}
+	}
+}
+
+// Real performs a forward FFT of the real valued input and returns only the
+// Size()/2+1 non-redundant bins. The result is written into dst if it has
+// enough capacity, otherwise a new slice is allocated.
+func (p *FFTPlan) Real(dst []complex128, input []float64) []complex128 {
+	if len(input) != p.n {
+		panic(fmt.Sprintf("fft: input length %d does not match plan size %d", len(input), p.n))
+	}
+
+	n := p.n
+	if cap(dst) < n/2+1 {
+		dst = make([]complex128, n/2+1)
+	}
+	dst = dst[:n/2+1]
+
+	if n == 1 {
+		dst[0] = complex(input[0], 0)
+		return dst
+	}
+
+	// pack the even samples into the real part and the odd samples into the
+	// imaginary part and do a half sized complex transform
+	half := n / 2
+	z := dst[:half]
+	for i := range z {
+		z[i] = complex(input[2*i], input[2*i+1])
+	}
+	p.transform(z, p.halfRev)
+
+	// then untangle the two interleaved transforms
+	z0 := z[0]
+	dst[0] = complex(real(z0)+imag(z0), 0)
+	dst[half] = complex(real(z0)-imag(z0), 0)
+	for k := 1; k <= half/2; k++ {
+		m := half - k
+		zk, zm := dst[k], dst[m]
+		dst[k] = untangle(zk, zm, p.twiddle[k])
+		if k != m {
+			dst[m] = untangle(zm, zk, p.twiddle[m])
+		}
+	}
+
+	return dst
+}
+
+// untangle computes bin k of a real transform from the packed half sized
+// transform values zk = Z[k] and zm = Z[n/2-k], w is exp(-2πik/n)
+func untangle(zk, zm, w complex128) complex128 {
+	zmc := complex(real(zm), -imag(zm))
+	even := (zk + zmc) / 2
+	odd := (zk - zmc) / 2
+	// multiply odd by -i·w
+	return even + complex(0, -1)*w*odd
 }
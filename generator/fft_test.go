@@ -0,0 +1,155 @@
+package generator
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand/v2"
+	"testing"
+)
+
+// dft is the naive O(n²) discrete Fourier transform the FFT is checked against
+func dft(input []complex128) []complex128 {
+	n := len(input)
+	out := make([]complex128, n)
+	for k := range out {
+		var sum complex128
+		for t, v := range input {
+			angle := -2 * math.Pi * float64(k*t%n) / float64(n)
+			sum += v * complex(math.Cos(angle), math.Sin(angle))
+		}
+		out[k] = sum
+	}
+	return out
+}
+
+// recursiveFFT is the allocating recursive FFT the plans replaced, it is kept
+// to benchmark against
+func recursiveFFT(input []complex128) []complex128 {
+	n := len(input)
+	if n <= 1 {
+		return input
+	}
+
+	even := make([]complex128, n/2)
+	odd := make([]complex128, n/2)
+	for i := 0; i < n/2; i++ {
+		even[i] = input[2*i]
+		odd[i] = input[2*i+1]
+	}
+	even, odd = recursiveFFT(even), recursiveFFT(odd)
+
+	out := make([]complex128, n)
+	for k := 0; k < n/2; k++ {
+		t := cmplx.Rect(1, -2*math.Pi*float64(k)/float64(n))
+		out[k] = even[k] + t*odd[k]
+		out[k+n/2] = even[k] - t*odd[k]
+	}
+	return out
+}
+
+func randomSignal(n int, seed uint64) []float64 {
+	r := rand.New(rand.NewPCG(seed, seed))
+	signal := make([]float64, n)
+	for i := range signal {
+		signal[i] = r.Float64()*2 - 1
+	}
+	return signal
+}
+
+func toComplex(input []float64) []complex128 {
+	out := make([]complex128, len(input))
+	for i, v := range input {
+		out[i] = complex(v, 0)
+	}
+	return out
+}
+
+func assertBins(t *testing.T, n int, got, want []complex128) {
+	t.Helper()
+	// the error of both grows with n, so scale the tolerance with it
+	tolerance := 1e-9 * float64(n)
+	for k := range want {
+		if cmplx.Abs(got[k]-want[k]) > tolerance {
+			t.Fatalf("n=%d bin %d: got %v, want %v", n, k, got[k], want[k])
+		}
+	}
+}
+
+func TestFFT(t *testing.T) {
+	for _, n := range []int{1, 2, 4, 8, 64, 1024} {
+		input := randomSignal(n, uint64(n))
+		assertBins(t, n, FFT(input), dft(toComplex(input)))
+	}
+}
+
+func TestReal(t *testing.T) {
+	for _, n := range []int{1, 2, 4, 8, 64, 1024} {
+		plan, err := NewFFTPlan(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		input := randomSignal(n, uint64(n))
+		got := plan.Real(nil, input)
+		if len(got) != n/2+1 {
+			t.Fatalf("n=%d: got %d bins, want %d", n, len(got), n/2+1)
+		}
+		assertBins(t, n, got, dft(toComplex(input))[:n/2+1])
+	}
+}
+
+func TestNewFFTPlanRejectsOtherSizes(t *testing.T) {
+	for _, n := range []int{0, -4, 3, 1000} {
+		if _, err := NewFFTPlan(n); err == nil {
+			t.Errorf("n=%d: expected an error", n)
+		}
+	}
+}
+
+func BenchmarkFFT(b *testing.B) {
+	input := randomSignal(DefaultSpectrogramConfig.WindowSize, 1)
+	plan, err := NewFFTPlan(len(input))
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := make([]complex128, len(input))
+
+	b.Run("plan", func(b *testing.B) {
+		for b.Loop() {
+			for i, v := range input {
+				data[i] = complex(v, 0)
+			}
+			plan.Transform(data)
+		}
+	})
+	b.Run("recursive", func(b *testing.B) {
+		for b.Loop() {
+			recursiveFFT(toComplex(input))
+		}
+	})
+}
+
+func BenchmarkReal(b *testing.B) {
+	input := randomSignal(DefaultSpectrogramConfig.WindowSize, 1)
+	plan, err := NewFFTPlan(len(input))
+	if err != nil {
+		b.Fatal(err)
+	}
+	dst := make([]complex128, len(input)/2+1)
+
+	for b.Loop() {
+		dst = plan.Real(dst, input)
+	}
+}
+
+func BenchmarkSpectrogram(b *testing.B) {
+	// ten seconds of audio at 44.1kHz
+	samples := randomSignal(10*44100, 1)
+	b.SetBytes(int64(len(samples)) * 2)
+
+	for b.Loop() {
+		if _, err := Spectrogram(samples, 44100); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package generator
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Wessie/fingerprinter/storage"
+)
+
+// HashFields are the components an address is built from
+type HashFields struct {
+	// AnchorBin is the frequency bin of the anchor peak
+	AnchorBin uint32
+	// TargetBin is the frequency bin of the target peak
+	TargetBin uint32
+	// DeltaMs is the time between the anchor and target peak in milliseconds
+	DeltaMs uint32
+}
+
+func (f HashFields) String() string {
+	return fmt.Sprintf("anchor=%d target=%d delta=%dms", f.AnchorBin, f.TargetBin, f.DeltaMs)
+}
+
+// HashCodec defines the bit layout of an address, from most to least
+// significant bits an address holds the anchor bin, the target bin and the
+// time delta.
+type HashCodec struct {
+	name      string
+	version   uint32
+	freqBits  uint
+	deltaBits uint
+}
+
+var (
+	// Hash32 uses 9 bits per frequency bin and 14 bits for the delta, for a
+	// total of 32 bits
+	Hash32 = HashCodec{name: "hash32", version: 1, freqBits: 9, deltaBits: 14}
+	// Hash64 uses 16 bits per frequency bin and 24 bits for the delta, for a
+	// total of 56 bits so addresses stay positive as a signed 64-bit integer
+	Hash64 = HashCodec{name: "hash64", version: 2, freqBits: 16, deltaBits: 24}
+
+	// DefaultHashCodec is the codec used when none is given
+	DefaultHashCodec = Hash32
+)
+
+var hashCodecs = []HashCodec{Hash32, Hash64}
+
+// HashCodecByVersion returns the codec with the version given
+func HashCodecByVersion(version uint32) (HashCodec, bool) {
+	for _, c := range hashCodecs {
+		if c.version == version {
+			return c, true
+		}
+	}
+	return HashCodec{}, false
+}
+
+// ErrHashField is returned when a field doesn't fit in the layout of a codec
+var ErrHashField = errors.New("hash field out of range")
+
+// Version returns the version of the layout, this is what is stored in storage
+func (c HashCodec) Version() uint32 {
+	return c.version
+}
+
+// Bits returns the amount of bits used by an address
+func (c HashCodec) Bits() uint {
+	return 2*c.freqBits + c.deltaBits
+}
+
+func (c HashCodec) String() string {
+	return c.name + "/v" + strconv.Itoa(int(c.version))
+}
+
+// Encode packs the fields into an address, an error is returned if any of
+// them doesn't fit in its part of the layout
+func (c HashCodec) Encode(f HashFields) (storage.Address, error) {
+	freqMax := uint32(1)<<c.freqBits - 1
+	deltaMax := uint32(1)<<c.deltaBits - 1
+
+	if f.AnchorBin > freqMax {
+		return 0, fmt.Errorf("%w: anchor bin %d is larger than %d", ErrHashField, f.AnchorBin, freqMax)
+	}
+	if f.TargetBin > freqMax {
+		return 0, fmt.Errorf("%w: target bin %d is larger than %d", ErrHashField, f.TargetBin, freqMax)
+	}
+	if f.DeltaMs > deltaMax {
+		return 0, fmt.Errorf("%w: delta %dms is larger than %dms", ErrHashField, f.DeltaMs, deltaMax)
+	}
+
+	address := storage.Address(f.AnchorBin)<<(c.freqBits+c.deltaBits) |
+		storage.Address(f.TargetBin)<<c.deltaBits |
+		storage.Address(f.DeltaMs)
+	return address, nil
+}
+
+// Decode unpacks an address into its fields
+func (c HashCodec) Decode(address storage.Address) HashFields {
+	freqMask := storage.Address(1)<<c.freqBits - 1
+	deltaMask := storage.Address(1)<<c.deltaBits - 1
+
+	return HashFields{
+		AnchorBin: uint32(address >> (c.freqBits + c.deltaBits) & freqMask),
+		TargetBin: uint32(address >> c.deltaBits & freqMask),
+		DeltaMs:   uint32(address & deltaMask),
+	}
+}
+
+// Address generates the address for a pair of anchor and target peaks, the
+// target has to come after the anchor
+func (c HashCodec) Address(anchor, target Peak) (storage.Address, error) {
+	if anchor.Bin < 0 || target.Bin < 0 {
+		return 0, fmt.Errorf("%w: negative bin", ErrHashField)
+	}
+
+	deltaMs := int64((target.Time - anchor.Time) * 1000)
+	if deltaMs < 0 || deltaMs > int64(^uint32(0)) {
+		return 0, fmt.Errorf("%w: delta %dms", ErrHashField, deltaMs)
+	}
+
+	return c.Encode(HashFields{
+		AnchorBin: uint32(anchor.Bin),
+		TargetBin: uint32(target.Bin),
+		DeltaMs:   uint32(deltaMs),
+	})
+}
+
+// hashCodecKey is the storage setting the hash codec version is recorded under
+const hashCodecKey = "hash_codec_version"
+
+// StoredHashCodec returns the codec recorded in db. If db has none recorded
+// yet it is set to def, but only if it has no songs.
+func StoredHashCodec(db storage.Storage, def HashCodec) (HashCodec, error) {
+	return storedHashCodec(db, def, true)
+}
+
+// storedHashCodec is StoredHashCodec, it only records def if record is true
+func storedHashCodec(db storage.Storage, def HashCodec, record bool) (HashCodec, error) {
+	value, ok, err := db.GetSetting(hashCodecKey)
+	if err != nil {
+		return HashCodec{}, err
+	}
+	if !ok {
+		if err := checkUnrecorded(db, hashCodecKey); err != nil {
+			return HashCodec{}, err
+		}
+		if record {
+			return def, RecordHashCodec(db, def)
+		}
+		return def, nil
+	}
+
+	version, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return HashCodec{}, fmt.Errorf("invalid %s in storage: %w", hashCodecKey, err)
+	}
+	c, ok := HashCodecByVersion(uint32(version))
+	if !ok {
+		return HashCodec{}, fmt.Errorf("%w: unknown hash codec version %d in storage", ErrVersionMismatch, version)
+	}
+	return c, nil
+}
+
+// RecordHashCodec records c as the codec of db no matter what was recorded
+// before, this is only correct if every song is fingerprinted again
+func RecordHashCodec(db storage.Storage, c HashCodec) error {
+	return db.SetSetting(hashCodecKey, strconv.FormatUint(uint64(c.version), 10))
+}
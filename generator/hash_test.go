@@ -0,0 +1,102 @@
+package generator
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Wessie/fingerprinter/storage"
+)
+
+func TestHashCodecRoundTrip(t *testing.T) {
+	for _, codec := range []HashCodec{Hash32, Hash64} {
+		fields := HashFields{
+			AnchorBin: 1<<codec.freqBits - 1,
+			TargetBin: 3,
+			DeltaMs:   1<<codec.deltaBits - 1,
+		}
+		address, err := codec.Encode(fields)
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		if got := codec.Decode(address); got != fields {
+			t.Errorf("%s: decoded %s, want %s", codec, got, fields)
+		}
+
+		fields.TargetBin = 1 << codec.freqBits
+		if _, err := codec.Encode(fields); !errors.Is(err, ErrHashField) {
+			t.Errorf("%s: got %v for a bin that doesn't fit, want ErrHashField", codec, err)
+		}
+	}
+}
+
+func TestStoredHashCodecRejectsUnrecordedSongs(t *testing.T) {
+	db := storage.NewMemoryStorage()
+	if _, err := db.RegisterSong("key", "song"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := StoredHashCodec(db, Hash32); !errors.Is(err, ErrVersionMismatch) {
+		t.Fatalf("got %v, want ErrVersionMismatch", err)
+	}
+
+	if err := RecordHashCodec(db, Hash64); err != nil {
+		t.Fatal(err)
+	}
+	codec, err := StoredHashCodec(db, Hash32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec != Hash64 {
+		t.Errorf("got %s, want the recorded %s", codec, Hash64)
+	}
+}
+
+// settingsCounter counts the calls to the settings of a storage
+type settingsCounter struct {
+	storage.Storage
+	gets, sets int
+}
+
+func (c *settingsCounter) GetSetting(key string) (string, bool, error) {
+	c.gets++
+	return c.Storage.GetSetting(key)
+}
+
+func (c *settingsCounter) SetSetting(key, value string) error {
+	c.sets++
+	return c.Storage.SetSetting(key, value)
+}
+
+func TestMatcherReadsSettingsOnce(t *testing.T) {
+	song := newSynthSong(1, 20*time.Second)
+	db := &settingsCounter{Storage: indexSongs(t, song)}
+
+	matcher, err := NewMatcher(db, DefaultSpectrogramConfig, BandPeakExtractor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gets := db.gets
+
+	for range 2 {
+		if _, _, err := matcher.Find(song.render(44100, 5*time.Second, 5*time.Second), 5*time.Second, 44100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.gets != gets || db.sets != 0 {
+		t.Errorf("Find read %d and wrote %d settings", db.gets-gets, db.sets)
+	}
+
+	// the matcher doesn't record anything either, even on empty storage
+	empty := &settingsCounter{Storage: storage.NewMemoryStorage()}
+	if _, err := NewMatcher(empty, DefaultSpectrogramConfig, BandPeakExtractor{}); err != nil {
+		t.Fatal(err)
+	}
+	if empty.sets != 0 {
+		t.Errorf("NewMatcher wrote %d settings", empty.sets)
+	}
+
+	if _, err := NewMatcher(db, DefaultSpectrogramConfig, DefaultConstellationPeakExtractor); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("other peak extractor: got %v, want ErrVersionMismatch", err)
+	}
+}
@@ -2,6 +2,7 @@ package generator
 
 import (
 	"cmp"
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -13,19 +14,88 @@ import (
 )
 
 type Match struct {
-	SongID    uint32
-	SongKey   string
-	Metadata  string
-	Timestamp uint32
-	Score     float64
+	SongID   uint32
+	SongKey  string
+	Metadata string
+	Score    float64
+	// Offset is the estimated position in the song the samples start at, this
+	// is negative if the samples start before the song
+	Offset time.Duration
+	// Span is the time between the first and last hash in the song that
+	// agreed with Offset
+	Span time.Duration
+	// Aligned is the amount of hashes that agreed with Offset
+	Aligned int
+	// Queried is the amount of hashes generated from the samples
+	Queried int
+	// Confidence is how sure we are this is the song the samples came from,
+	// between 0 and 1
+	Confidence float64
 }
 
-func NewMatcher(db storage.Storage) *Matcher {
-	return &Matcher{db}
+// offsetToleranceMs is the width of the offset histogram buckets
+const offsetToleranceMs = 100
+
+// DefaultMinConfidence is the confidence the best match needs to reach before
+// Find considers it a match
+const DefaultMinConfidence = 0.5
+
+// ErrNoMatch is matched by the error Find returns when no song reached the
+// minimum confidence
+var ErrNoMatch = errors.New("no confident match")
+
+// NoMatchError is returned by Find when no song reached the minimum confidence
+type NoMatchError struct {
+	// Candidates are all the songs that matched, best first
+	Candidates []Match
+}
+
+func (e *NoMatchError) Error() string {
+	if len(e.Candidates) == 0 {
+		return ErrNoMatch.Error()
+	}
+	best := e.Candidates[0]
+	return fmt.Sprintf("%s: best was %q with confidence %.2f", ErrNoMatch, best.Metadata, best.Confidence)
+}
+
+func (e *NoMatchError) Is(target error) bool {
+	return target == ErrNoMatch
+}
+
+// NewMatcher returns a matcher for the songs in db, cfg and peaks have to be
+// what the songs were fingerprinted with. The versions recorded in db are
+// checked and its hash codec is read once here, the matcher never writes to db.
+func NewMatcher(db storage.Storage, cfg SpectrogramConfig, peaks PeakExtractor) (*Matcher, error) {
+	if err := checkVersion(db, cfg, peaks, false); err != nil {
+		return nil, err
+	}
+
+	codec, err := storedHashCodec(db, DefaultHashCodec, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Matcher{
+		db:     db,
+		config: cfg,
+		peaks:  peaks,
+		codec:  codec,
+
+		MinConfidence: DefaultMinConfidence,
+	}, nil
 }
 
 type Matcher struct {
 	db storage.Storage
+	// config is the configuration used to compute the spectrogram of samples
+	config SpectrogramConfig
+	// peaks is used to pick the peaks out of the spectrogram
+	peaks PeakExtractor
+	// codec is the hash layout recorded in storage
+	codec HashCodec
+	// MinConfidence is the confidence the best match needs to reach, if it
+	// doesn't Find returns a NoMatchError
+	MinConfidence float64
 }
 
 func randomID() uint32 {
@@ -33,25 +103,25 @@ func randomID() uint32 {
 }
 
 // FindMatches processes the audio samples and finds matches in the database
-func (m Matcher) Find(audioSamples []float64, audioDuration time.Duration, sampleRate int) ([]Match, time.Duration, error) {
+func (m *Matcher) Find(audioSamples []float64, audioDuration time.Duration, sampleRate int) ([]Match, time.Duration, error) {
 	startTime := time.Now()
 
-	spectrogram, err := Spectrogram(audioSamples, sampleRate)
+	spectrogram, err := m.config.Spectrogram(audioSamples, sampleRate)
 	if err != nil {
 		return nil, time.Since(startTime), fmt.Errorf("failed to get spectrogram of samples: %v", err)
 	}
 
-	log.Println("spec:", len(spectrogram), len(audioSamples)/44100, audioDuration)
-
-	peaks := ExtractPeaks(spectrogram, audioDuration)
-	log.Println("peaks:", len(peaks))
-	fingerprints := Fingerprint(peaks, randomID())
-
-	log.Println("fp:", len(fingerprints))
+	peaks := m.peaks.ExtractPeaks(spectrogram, m.config)
+	fingerprints := m.codec.Fingerprint(peaks, randomID())
 
+	// an address can occur more than once, it only has to be looked up once
+	seen := make(map[storage.Address]bool, len(fingerprints))
 	addresses := make([]storage.Address, 0, len(fingerprints))
-	for address := range fingerprints {
-		addresses = append(addresses, address)
+	for _, fp := range fingerprints {
+		if !seen[fp.Address] {
+			seen[fp.Address] = true
+			addresses = append(addresses, fp.Address)
+		}
 	}
 
 	matchCouples, err := m.db.GetCouples(addresses)
@@ -59,20 +129,24 @@ func (m Matcher) Find(audioSamples []float64, audioDuration time.Duration, sampl
 		return nil, time.Since(startTime), err
 	}
 
-	matches := map[uint32][][2]uint32{} // songID -> [(sampleTime, dbTime)]
-	timestamps := map[uint32][]uint32{} // songID -> [dbTime, dbTime, dbTime, ...]
+	queried := len(fingerprints)
 
-	for address, couples := range matchCouples {
-		for _, couple := range couples {
-			matches[couple.SongID] = append(matches[couple.SongID], [2]uint32{fingerprints[address].AnchorTimeMs, couple.AnchorTimeMs})
-			timestamps[couple.SongID] = append(timestamps[couple.SongID], couple.AnchorTimeMs)
+	// every occurrence in the samples is paired with every occurrence in the
+	// db, only the pairs with the right offset will line up. The samples are
+	// visited in order, which the histogram needs.
+	histogram := newOffsetHistogram(offsetToleranceMs)
+	for i, fp := range fingerprints {
+		for _, couple := range matchCouples[fp.Address] {
+			histogram.add(couple.SongID, hit{
+				query:    i,
+				sampleMs: fp.AnchorTimeMs,
+				dbMs:     couple.AnchorTimeMs,
+			})
 		}
 	}
 
-	scores := analyzeRelativeTiming(matches)
-
 	var matchList []Match
-	for songID, points := range scores {
+	for songID, alignment := range histogram.best() {
 		song, songExists, err := m.db.GetSongByID(songID)
 		if !songExists {
 			log.Printf("song with ID (%v) doesn't exist", songID)
@@ -83,34 +157,167 @@ func (m Matcher) Find(audioSamples []float64, audioDuration time.Duration, sampl
 			continue
 		}
 
-		slices.Sort(timestamps[songID])
-
-		match := Match{songID, song.Key, song.Metadata, timestamps[songID][0], points}
-		matchList = append(matchList, match)
+		matchList = append(matchList, Match{
+			SongID:   songID,
+			SongKey:  song.Key,
+			Metadata: song.Metadata,
+			Score:    float64(alignment.count),
+			Offset:   time.Duration(alignment.offsetMs) * time.Millisecond,
+			Span:     time.Duration(alignment.lastMs-alignment.firstMs) * time.Millisecond,
+			Aligned:  alignment.count,
+			Queried:  queried,
+		})
 	}
 
 	slices.SortFunc(matchList, func(i, j Match) int {
 		return cmp.Compare(j.Score, i.Score)
 	})
 
+	// every match is compared against the best other match, which means only
+	// the first one can be confident
+	for i := range matchList {
+		var runnerUp int
+		if i == 0 && len(matchList) > 1 {
+			runnerUp = matchList[1].Aligned
+		} else if i > 0 {
+			runnerUp = matchList[0].Aligned
+		}
+		matchList[i].Confidence = confidence(matchList[i].Aligned, queried, runnerUp)
+	}
+
+	if len(matchList) == 0 || matchList[0].Confidence < m.MinConfidence {
+		return nil, time.Since(startTime), &NoMatchError{Candidates: matchList}
+	}
+
 	return matchList, time.Since(startTime), nil
 }
 
-// AnalyzeRelativeTiming checks for consistent relative timing and returns a score
-func analyzeRelativeTiming(matches map[uint32][][2]uint32) map[uint32]float64 {
-	scores := make(map[uint32]float64)
-	for songID, times := range matches {
-		count := 0
-		for i := 0; i < len(times); i++ {
-			for j := i + 1; j < len(times); j++ {
-				sampleDiff := math.Abs(float64(times[i][0] - times[j][0]))
-				dbDiff := math.Abs(float64(times[i][1] - times[j][1]))
-				if math.Abs(sampleDiff-dbDiff) < 100 { // Allow some tolerance
-					count++
-				}
-			}
+const (
+	// confidenceAligned is the amount of hashes above chance at which we're
+	// about two thirds sure it isn't chance
+	confidenceAligned = 20
+	// confidenceChance is the fraction of the queried hashes that can align
+	// with a song the samples aren't from, wrong songs stay below 2% on music
+	// and below 8% on a pure tone
+	confidenceChance = 0.05
+	// confidenceCoverage is the fraction of the queried hashes that have to
+	// align before the coverage stops lowering the confidence, the right song
+	// aligns 85% or more of them even with noise
+	confidenceCoverage = 0.3
+)
+
+// confidence combines the amount of aligned hashes above what is expected by
+// chance for queried hashes, the fraction of the queried hashes they make up
+// and the gap to the runner-up into a number between 0 and 1
+func confidence(aligned, queried, runnerUp int) float64 {
+	if aligned <= 0 || queried <= 0 {
+		return 0
+	}
+
+	chance := confidenceChance * float64(queried)
+	evidence := 1 - math.Exp(-max(0, float64(aligned)-chance)/confidenceAligned)
+	coverage := min(1, float64(aligned)/float64(queried)/confidenceCoverage)
+	gap := max(0, 1-float64(runnerUp)/float64(aligned))
+	return evidence * coverage * gap
+}
+
+// hit is an address that occurred in both the samples and a song
+type hit struct {
+	// query is the index of the fingerprint in the samples
+	query int
+	// sampleMs and dbMs are the anchor times in the samples and the song
+	sampleMs, dbMs uint32
+}
+
+// offset returns the offset between the db and sample time, calculated in
+// int64 so that offsets before the start of the song don't wrap around
+func (h hit) offset() int64 {
+	return int64(h.dbMs) - int64(h.sampleMs)
+}
+
+// alignment is the best aligned window of offsets of a song
+type alignment struct {
+	// count is the amount of sample fingerprints in the window
+	count int
+	// offsetMs is the average offset in the window
+	offsetMs int64
+	// firstMs and lastMs are the earliest and latest db time in the window
+	firstMs, lastMs uint32
+}
+
+// offsetBucket is a window of offsets of a song in an offsetHistogram
+type offsetBucket struct {
+	songID uint32
+	window int64
+}
+
+type offsetCount struct {
+	alignment
+	sum int64
+	// lastQuery is the last sample fingerprint counted, so every sample
+	// fingerprint counts once no matter how often its address is in the song
+	lastQuery int
+}
+
+// offsetHistogram counts the offsets of hits per song in windows two tolerance
+// wide that start every tolerance milliseconds, so offsets that are close
+// together always share a window even if they're on both sides of a multiple
+// of tolerance
+type offsetHistogram struct {
+	tolerance int64
+	counts    map[offsetBucket]*offsetCount
+}
+
+func newOffsetHistogram(tolerance int64) *offsetHistogram {
+	return &offsetHistogram{
+		tolerance: tolerance,
+		counts:    map[offsetBucket]*offsetCount{},
+	}
+}
+
+// add counts h for the song given, hits have to be added in the order of
+// their sample fingerprint
+func (oh *offsetHistogram) add(songID uint32, h hit) {
+	offset := h.offset()
+	// round towards negative infinity so every bucket is equally wide
+	bucket := offset / oh.tolerance
+	if offset < 0 && offset%oh.tolerance != 0 {
+		bucket--
+	}
+
+	// the windows starting in the bucket before and in this one
+	for window := bucket - 1; window <= bucket; window++ {
+		key := offsetBucket{songID, window}
+		c := oh.counts[key]
+		if c == nil {
+			c = &offsetCount{lastQuery: -1}
+			c.firstMs, c.lastMs = h.dbMs, h.dbMs
+			oh.counts[key] = c
+		}
+		if c.lastQuery == h.query {
+			continue
+		}
+		c.lastQuery = h.query
+		c.count++
+		c.sum += offset
+		c.firstMs = min(c.firstMs, h.dbMs)
+		c.lastMs = max(c.lastMs, h.dbMs)
+	}
+}
+
+// best returns the alignment of the fullest window of every song, ties go to
+// the earliest offset
+func (oh *offsetHistogram) best() map[uint32]alignment {
+	best := map[uint32]alignment{}
+	window := map[uint32]int64{}
+	for key, c := range oh.counts {
+		current, ok := best[key.songID]
+		if ok && (c.count < current.count || c.count == current.count && key.window > window[key.songID]) {
+			continue
 		}
-		scores[songID] = float64(count)
+		a := c.alignment
+		a.offsetMs = c.sum / int64(c.count)
+		best[key.songID], window[key.songID] = a, key.window
 	}
-	return scores
+	return best
 }
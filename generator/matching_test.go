@@ -0,0 +1,174 @@
+package generator
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestOffsetHistogram(t *testing.T) {
+	tests := []struct {
+		name string
+		hits []hit
+		want alignment
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "aligned with noise",
+			hits: []hit{
+				{0, 0, 1000}, {1, 100, 1100}, {2, 250, 1250}, {3, 300, 1300}, {4, 900, 1900},
+				{5, 100, 7000}, {6, 400, 200},
+			},
+			want: alignment{count: 5, offsetMs: 1000, firstMs: 1000, lastMs: 1900},
+		},
+		{
+			// the samples start before the song, in uint32 the offset
+			// wrapped around to about 4.29e9
+			name: "negative offset",
+			hits: []hit{
+				{0, 5000, 1000}, {1, 5500, 1500}, {2, 6000, 2000}, {3, 9000, 5000},
+				{4, 5000, 90000},
+			},
+			want: alignment{count: 4, offsetMs: -4000, firstMs: 1000, lastMs: 5000},
+		},
+		{
+			name: "offset beyond int32",
+			hits: []hit{
+				{0, 10, math.MaxUint32 - 90}, {1, 20, math.MaxUint32 - 80}, {2, 30, math.MaxUint32 - 70},
+				{3, 40, 100},
+			},
+			want: alignment{count: 3, offsetMs: math.MaxUint32 - 100, firstMs: math.MaxUint32 - 90, lastMs: math.MaxUint32 - 70},
+		},
+		{
+			// a sustained tone repeats one address, every sample
+			// fingerprint counts once no matter how often it occurs
+			name: "repeated sample fingerprint",
+			hits: []hit{
+				{0, 0, 2000}, {0, 0, 2010}, {0, 0, 2020}, {0, 0, 2030},
+				{1, 500, 9000}, {2, 600, 9100},
+			},
+			want: alignment{count: 2, offsetMs: 8500, firstMs: 9000, lastMs: 9100},
+		},
+		{
+			name: "jitter within tolerance",
+			hits: []hit{
+				{0, 0, 3010}, {1, 100, 3120}, {2, 200, 3250}, {3, 300, 3390},
+			},
+			want: alignment{count: 4, offsetMs: 3042, firstMs: 3010, lastMs: 3390},
+		},
+		{
+			// offsets on both sides of a multiple of the tolerance
+			// used to be split over two buckets
+			name: "bucket boundary",
+			hits: []hit{
+				{0, 0, 990}, {1, 100, 1110}, {2, 200, 1195}, {3, 300, 1305},
+				{4, 400, 5000},
+			},
+			want: alignment{count: 4, offsetMs: 1000, firstMs: 990, lastMs: 1305},
+		},
+		{
+			name: "negative bucket boundary",
+			hits: []hit{
+				{0, 1010, 1000}, {1, 1100, 1105}, {2, 1200, 1190},
+			},
+			want: alignment{count: 3, offsetMs: -5, firstMs: 1000, lastMs: 1190},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			histogram := newOffsetHistogram(offsetToleranceMs)
+			for _, h := range tt.hits {
+				histogram.add(1, h)
+			}
+			if got := histogram.best()[1]; got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfidence(t *testing.T) {
+	tests := []struct {
+		name                       string
+		aligned, queried, runnerUp int
+		min, max                   float64
+	}{
+		{"nothing aligned", 0, 1000, 0, 0, 0},
+		{"nothing queried", 10, 0, 0, 0, 0},
+		// a 20s window of music against a song it isn't from, about 1.5% of
+		// the hashes line up by chance
+		{"chance on a long window", 1050, 70000, 200, 0, 0.01},
+		{"right song", 40000, 44000, 900, 0.95, 1},
+		{"right song on a short window", 40, 50, 0, 0.8, 1},
+		{"tied with the runner-up", 40000, 44000, 40000, 0, 0},
+		{"low coverage", 5000, 70000, 0, 0, 0.3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := confidence(tt.aligned, tt.queried, tt.runnerUp)
+			if got < tt.min || got > tt.max {
+				t.Errorf("got %.3f, want between %v and %v", got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestConfidenceCorpus(t *testing.T) {
+	var songs []synthSong
+	for seed := range uint64(6) {
+		songs = append(songs, newSynthSong(seed+1, 30*time.Second))
+	}
+	db := indexSongs(t, songs...)
+
+	matcher, err := NewMatcher(db, DefaultSpectrogramConfig, BandPeakExtractor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const length = 10 * time.Second
+	tone := make([]float64, int(length.Seconds()*44100))
+	for i := range tone {
+		tone[i] = 0.3 * math.Sin(2*math.Pi*440*float64(i)/44100)
+	}
+
+	tests := []struct {
+		name    string
+		samples []float64
+		rate    int
+		// song is the ID of the song the samples are from, 0 if none
+		song uint32
+	}{
+		{"song 1", addNoise(songs[0].render(44100, 5*time.Second, length), 0.02, 1), 44100, 1},
+		{"song 2 with noise", addNoise(songs[1].render(44100, 12*time.Second, length), 0.3, 2), 44100, 2},
+		{"song 4 with noise", addNoise(songs[3].render(44100, 0, length), 0.3, 3), 44100, 4},
+		{"song 6 at 48000", addNoise(songs[5].render(48000, 20*time.Second, length), 0.1, 4), 48000, 6},
+		{"unknown song", addNoise(newSynthSong(100, length).render(44100, 0, length), 0.02, 5), 44100, 0},
+		{"other unknown song", newSynthSong(101, length).render(44100, 0, length), 44100, 0},
+		{"white noise", addNoise(make([]float64, len(tone)), 0.2, 6), 44100, 0},
+		{"tone", tone, 44100, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches, _, err := matcher.Find(tt.samples, length, tt.rate)
+			if tt.song == 0 {
+				if !errors.Is(err, ErrNoMatch) {
+					t.Errorf("got %v, want ErrNoMatch", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if best := matches[0]; best.SongID != tt.song {
+				t.Errorf("matched song %d with confidence %.3f, want %d", best.SongID, best.Confidence, tt.song)
+			}
+		})
+	}
+}
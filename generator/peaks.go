@@ -0,0 +1,262 @@
+package generator
+
+import (
+	"cmp"
+	"math"
+	"math/cmplx"
+	"slices"
+)
+
+// Peak is a single point of interest in a spectrogram
+type Peak struct {
+	// Frame is the index of the spectrogram frame the peak is in
+	Frame int
+	// Bin is the index of the frequency bin the peak is in
+	Bin int
+	// Time is the start of the frame in seconds
+	Time float64
+	// Freq is the frequency of the peak in Hz, interpolated between the
+	// neighbouring bins
+	Freq float64
+	// Magnitude is the magnitude of the bin
+	Magnitude float64
+}
+
+// newPeak returns the Peak for the bin given
+func newPeak(spectrogram [][]complex128, cfg SpectrogramConfig, frame, bin int) Peak {
+	row := spectrogram[frame]
+	magnitude := cmplx.Abs(row[bin])
+
+	// parabolic interpolation over the log magnitude of the neighbouring bins
+	offset := 0.0
+	if bin > 0 && bin < len(row)-1 {
+		a := math.Log(cmplx.Abs(row[bin-1]) + 1e-12)
+		b := math.Log(magnitude + 1e-12)
+		c := math.Log(cmplx.Abs(row[bin+1]) + 1e-12)
+		if denom := a - 2*b + c; denom < 0 {
+			offset = 0.5 * (a - c) / denom
+		}
+	}
+
+	return Peak{
+		Frame:     frame,
+		Bin:       bin,
+		Time:      float64(frame) * cfg.FrameDuration(),
+		Freq:      (float64(bin) + offset) * float64(cfg.SampleRate) / float64(cfg.WindowSize),
+		Magnitude: magnitude,
+	}
+}
+
+// PeakExtractor picks the peaks used for fingerprinting out of a spectrogram
+// that was computed with cfg
+type PeakExtractor interface {
+	ExtractPeaks(spectrogram [][]complex128, cfg SpectrogramConfig) []Peak
+}
+
+// BandPeakExtractor takes the strongest bin of a fixed set of frequency bands
+// in each frame, see ExtractPeaks
+type BandPeakExtractor struct{}
+
+func (BandPeakExtractor) ExtractPeaks(spectrogram [][]complex128, cfg SpectrogramConfig) []Peak {
+	return ExtractPeaks(spectrogram, cfg)
+}
+
+// ConstellationPeakExtractor picks peaks that are the local maximum of a
+// time×frequency neighbourhood and stand out from the average magnitude
+// around them, it then keeps the strongest ones until PeaksPerSecond is
+// reached.
+type ConstellationPeakExtractor struct {
+	// TimeRadius is the amount of frames on each side of a peak it has to be
+	// the maximum of
+	TimeRadius int
+	// FreqRadius is the amount of bins on each side of a peak it has to be
+	// the maximum of
+	FreqRadius int
+	// Threshold is how many times larger than the average magnitude of the
+	// frames around it a peak has to be
+	Threshold float64
+	// PeaksPerSecond is the target density of peaks, zero keeps all of them
+	PeaksPerSecond float64
+}
+
+// DefaultConstellationPeakExtractor is tuned for the DefaultSpectrogramConfig
+var DefaultConstellationPeakExtractor = ConstellationPeakExtractor{
+	TimeRadius:     16,
+	FreqRadius:     12,
+	Threshold:      2,
+	PeaksPerSecond: 30,
+}
+
+func (ce ConstellationPeakExtractor) ExtractPeaks(spectrogram [][]complex128, cfg SpectrogramConfig) []Peak {
+	if len(spectrogram) < 1 {
+		return []Peak{}
+	}
+
+	frames, bins := len(spectrogram), len(spectrogram[0])
+	binDuration := cfg.FrameDuration()
+
+	mags := make([][]float64, frames)
+	means := make([]float64, frames)
+	for t, frame := range spectrogram {
+		mags[t] = make([]float64, bins)
+		for f, v := range frame {
+			mags[t][f] = cmplx.Abs(v)
+			means[t] += mags[t][f]
+		}
+		means[t] /= float64(bins)
+	}
+
+	// the maximum of each neighbourhood, done as a max over frequency followed
+	// by a max over time
+	freqMax := make([][]float64, frames)
+	for t := range mags {
+		freqMax[t] = slidingMax(mags[t], ce.FreqRadius)
+	}
+	column := make([]float64, frames)
+	localMax := make([][]float64, frames)
+	for t := range localMax {
+		localMax[t] = make([]float64, bins)
+	}
+	for f := 0; f < bins; f++ {
+		for t := range column {
+			column[t] = freqMax[t][f]
+		}
+		for t, v := range slidingMax(column, ce.TimeRadius) {
+			localMax[t][f] = v
+		}
+	}
+
+	// the adaptive threshold is the average magnitude of the frames around
+	thresholds := slidingMean(means, ce.TimeRadius)
+
+	type candidate struct {
+		frame    int
+		bin      int
+		strength float64
+	}
+
+	var candidates []candidate
+	for t := range mags {
+		threshold := thresholds[t] * ce.Threshold
+		// the last bin is the nyquist frequency, which the resampler
+		// filtered out and which doesn't fit the frequency field of Hash32
+		for f, mag := range mags[t][:bins-1] {
+			if mag == 0 || mag < localMax[t][f] || mag <= threshold {
+				continue
+			}
+			candidates = append(candidates, candidate{t, f, mag / max(threshold, math.SmallestNonzeroFloat64)})
+		}
+	}
+
+	// keep the strongest candidates of every second to hit our target density
+	if ce.PeaksPerSecond > 0 && binDuration > 0 {
+		segment := max(1, int(1/binDuration))
+		perSegment := max(1, int(ce.PeaksPerSecond*float64(segment)*binDuration))
+
+		kept := candidates[:0]
+		for start := 0; start < len(candidates); {
+			end := start
+			for end < len(candidates) && candidates[end].frame/segment == candidates[start].frame/segment {
+				end++
+			}
+
+			group := candidates[start:end]
+			slices.SortFunc(group, func(a, b candidate) int {
+				return cmp.Compare(b.strength, a.strength)
+			})
+			group = group[:min(len(group), perSegment)]
+			slices.SortFunc(group, func(a, b candidate) int {
+				return cmp.Or(cmp.Compare(a.frame, b.frame), cmp.Compare(a.bin, b.bin))
+			})
+			kept = append(kept, group...)
+			start = end
+		}
+		candidates = kept
+	}
+
+	peaks := make([]Peak, 0, len(candidates))
+	for _, c := range candidates {
+		peaks = append(peaks, newPeak(spectrogram, cfg, c.frame, c.bin))
+	}
+	return peaks
+}
+
+// slidingMax returns the maximum of in over a window of radius elements on
+// each side of every element
+func slidingMax(in []float64, radius int) []float64 {
+	out := make([]float64, len(in))
+	// deque holds indices into in with decreasing values
+	deque := make([]int, 0, 2*radius+1)
+	next := 0
+	for i := range in {
+		for ; next < len(in) && next <= i+radius; next++ {
+			for len(deque) > 0 && in[deque[len(deque)-1]] <= in[next] {
+				deque = deque[:len(deque)-1]
+			}
+			deque = append(deque, next)
+		}
+		for deque[0] < i-radius {
+			deque = deque[1:]
+		}
+		out[i] = in[deque[0]]
+	}
+	return out
+}
+
+// slidingMean returns the mean of in over a window of radius elements on each
+// side of every element
+func slidingMean(in []float64, radius int) []float64 {
+	out := make([]float64, len(in))
+	var sum float64
+	lo, hi := 0, 0
+	for i := range in {
+		for ; hi < len(in) && hi <= i+radius; hi++ {
+			sum += in[hi]
+		}
+		for ; lo < i-radius; lo++ {
+			sum -= in[lo]
+		}
+		out[i] = sum / float64(hi-lo)
+	}
+	return out
+}
+
+// ExtractPeaks analyzes a spectrogram and extracts significant peaks in the frequency domain over time.
+func ExtractPeaks(spectrogram [][]complex128, cfg SpectrogramConfig) []Peak {
+	if len(spectrogram) < 1 {
+		return []Peak{}
+	}
+
+	bands := []struct{ min, max int }{{0, 10}, {10, 20}, {20, 40}, {40, 80}, {80, 160}, {160, 512}}
+
+	var peaks []Peak
+	maxMags := make([]float64, len(bands))
+	maxIdx := make([]int, len(bands))
+
+	for frameIdx, bin := range spectrogram {
+		// find the strongest bin in each band
+		var maxMagsSum float64
+		for i, band := range bands {
+			maxMags[i], maxIdx[i] = 0, -1
+			for idx := band.min; idx < min(band.max, len(bin)); idx++ {
+				magnitude := cmplx.Abs(bin[idx])
+				if magnitude > maxMags[i] {
+					maxMags[i], maxIdx[i] = magnitude, idx
+				}
+			}
+			maxMagsSum += maxMags[i]
+		}
+
+		// Calculate the average magnitude
+		avg := maxMagsSum / float64(len(bands))
+
+		// Add peaks that exceed the average magnitude
+		for i, value := range maxMags {
+			if value > avg && maxIdx[i] >= 0 {
+				peaks = append(peaks, newPeak(spectrogram, cfg, frameIdx, maxIdx[i]))
+			}
+		}
+	}
+
+	return peaks
+}
@@ -0,0 +1,37 @@
+package generator
+
+import (
+	"testing"
+)
+
+func TestPeakExtractorsFitHash32(t *testing.T) {
+	// a spectrogram with its strongest bins at the edges, which are the
+	// bins most likely to fall outside of the frequency field
+	cfg := DefaultSpectrogramConfig
+	bins := cfg.WindowSize/2 + 1
+	spectrogram := make([][]complex128, 200)
+	for i := range spectrogram {
+		spectrogram[i] = make([]complex128, bins)
+		for k := range spectrogram[i] {
+			spectrogram[i][k] = complex(float64((i*7+k*13)%17)+1, 0)
+		}
+		spectrogram[i][0] = 1000
+		spectrogram[i][bins-1] = 1000
+	}
+
+	extractors := map[string]PeakExtractor{
+		"band":          BandPeakExtractor{},
+		"constellation": DefaultConstellationPeakExtractor,
+	}
+	for name, extractor := range extractors {
+		peaks := extractor.ExtractPeaks(spectrogram, cfg)
+		if len(peaks) == 0 {
+			t.Errorf("%s: no peaks", name)
+		}
+		for _, peak := range peaks {
+			if _, err := Hash32.Address(peak, peak); err != nil {
+				t.Fatalf("%s: peak at bin %d doesn't fit: %v", name, peak.Bin, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package generator
+
+import (
+	"errors"
+	"math"
+)
+
+const (
+	// resampleAttenuation is the stopband attenuation of the resampling filter in dB
+	resampleAttenuation = 80
+	// maxResamplePhases is the largest interpolation factor we precompute the
+	// filter phases for, larger factors compute the taps for every sample
+	maxResamplePhases = 1024
+)
+
+// Resampler is a windowed-sinc polyphase FIR resampler that converts between
+// any two integer sample rates. It keeps its state between calls so a signal
+// can be resampled in chunks.
+type Resampler struct {
+	// up and down are the interpolation and decimation factors
+	up, down int64
+	// halfWidth is half the amount of input samples each output sample uses
+	halfWidth int
+	// fc is the cutoff of the filter relative to the input sample rate
+	fc   float64
+	beta float64
+	// phases holds the precomputed taps for every output phase, nil if the
+	// interpolation factor is too large
+	phases [][]float64
+	taps   []float64
+
+	// buf holds the input samples still needed, buf[0] is input sample bufStart
+	buf      []float64
+	bufStart int64
+	// in is the amount of input samples seen so far
+	in int64
+	// out is the index of the next output sample
+	out     int64
+	flushed bool
+}
+
+// NewResampler returns a Resampler going from fromRate to toRate, the filter
+// passes frequencies up to cutoff and fully attenuates everything above the
+// lowest nyquist frequency of the two rates. A cutoff of zero or one beyond
+// that picks 90% of the nyquist frequency.
+func NewResampler(fromRate, toRate int, cutoff float64) (*Resampler, error) {
+	if fromRate <= 0 || toRate <= 0 {
+		return nil, errors.New("sample rates must be positive")
+	}
+
+	g := gcd(fromRate, toRate)
+	up, down := int64(toRate/g), int64(fromRate/g)
+
+	nyquist := float64(min(fromRate, toRate)) / 2
+	if cutoff <= 0 || cutoff >= nyquist {
+		cutoff = nyquist * 0.9
+	}
+
+	// kaiser window design, see "Discrete-Time Signal Processing" by
+	// Oppenheim and Schafer
+	transition := 2 * math.Pi * (nyquist - cutoff) / float64(fromRate)
+	length := (resampleAttenuation - 8) / (2.285 * transition)
+
+	r := &Resampler{
+		up:        up,
+		down:      down,
+		halfWidth: int(math.Ceil(length/2)) + 1,
+		fc:        (cutoff + nyquist) / 2 / float64(fromRate),
+		beta:      0.1102 * (resampleAttenuation - 8.7),
+	}
+	r.taps = make([]float64, 2*r.halfWidth)
+
+	if up <= maxResamplePhases {
+		r.phases = make([][]float64, up)
+		for phase := range r.phases {
+			r.phases[phase] = r.computeTaps(make([]float64, 2*r.halfWidth), int64(phase))
+		}
+	}
+
+	// the signal is zero before the first sample
+	r.buf = make([]float64, r.halfWidth-1)
+	r.bufStart = -int64(r.halfWidth - 1)
+	return r, nil
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// computeTaps fills taps with the filter taps for the phase given, taps[i] is
+// applied to the input sample i-halfWidth+1 relative to the output position
+func (r *Resampler) computeTaps(taps []float64, phase int64) []float64 {
+	frac := float64(phase) / float64(r.up)
+	width := float64(r.halfWidth)
+	i0beta := besselI0(r.beta)
+	for i := range taps {
+		// distance between the output position and the input sample
+		u := frac - float64(i-r.halfWidth+1)
+		x := u / width
+		if x <= -1 || x >= 1 {
+			taps[i] = 0
+			continue
+		}
+		window := besselI0(r.beta*math.Sqrt(1-x*x)) / i0beta
+		taps[i] = 2 * r.fc * sinc(2*r.fc*u) * window
+	}
+	return taps
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// besselI0 is the zeroth order modified bessel function of the first kind
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; k < 64; k++ {
+		term *= (x / (2 * float64(k))) * (x / (2 * float64(k)))
+		sum += term
+		if term < sum*1e-17 {
+			break
+		}
+	}
+	return sum
+}
+
+// Process resamples input and appends the result to dst
+func (r *Resampler) Process(dst, input []float64) []float64 {
+	if r.flushed {
+		panic("resampler: process after flush")
+	}
+	r.buf = append(r.buf, input...)
+	r.in += int64(len(input))
+	return r.produce(dst, -1)
+}
+
+// Flush resamples the remaining input, treating everything after it as
+// silence, and appends the result to dst. The Resampler can't be used
+// afterwards.
+func (r *Resampler) Flush(dst []float64) []float64 {
+	if r.flushed {
+		return dst
+	}
+	r.flushed = true
+
+	total := (r.in*r.up + r.down - 1) / r.down
+	r.buf = append(r.buf, make([]float64, r.halfWidth)...)
+	return r.produce(dst, total)
+}
+
+// produce appends every output sample it has enough input for to dst, if
+// limit isn't negative no more than limit samples are produced in total
+func (r *Resampler) produce(dst []float64, limit int64) []float64 {
+	end := r.bufStart + int64(len(r.buf))
+	for limit < 0 || r.out < limit {
+		pos := r.out * r.down
+		idx, phase := pos/r.up, pos%r.up
+		if idx+int64(r.halfWidth) >= end {
+			break
+		}
+
+		taps := r.taps
+		if r.phases != nil {
+			taps = r.phases[phase]
+		} else {
+			r.computeTaps(taps, phase)
+		}
+
+		start := idx - int64(r.halfWidth-1) - r.bufStart
+		var y float64
+		for i, x := range r.buf[start : start+int64(len(taps))] {
+			y += x * taps[i]
+		}
+		dst = append(dst, y)
+		r.out++
+	}
+
+	// drop the input samples no future output needs
+	next := r.out * r.down / r.up
+	if drop := next - int64(r.halfWidth-1) - r.bufStart; drop > 0 && drop >= int64(len(r.buf))/2 {
+		drop = min(drop, int64(len(r.buf)))
+		r.buf = append(r.buf[:0], r.buf[drop:]...)
+		r.bufStart += drop
+	}
+	return dst
+}
+
+// Resample resamples input from fromRate to toRate in one go, see NewResampler
+// for the meaning of cutoff
+func Resample(input []float64, fromRate, toRate int, cutoff float64) ([]float64, error) {
+	r, err := NewResampler(fromRate, toRate, cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]float64, 0, len(input)*toRate/fromRate+1)
+	out = r.Process(out, input)
+	return r.Flush(out), nil
+}
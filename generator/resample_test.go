@@ -0,0 +1,210 @@
+package generator
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+	"time"
+)
+
+// sweep returns a linear sine sweep from f0 to f1 Hz sampled at rate, faded in
+// and out so the edges don't add energy at other frequencies
+func sweep(rate int, f0, f1 float64, length time.Duration) []float64 {
+	n := int(length.Seconds() * float64(rate))
+	fade := rate / 20
+	samples := make([]float64, n)
+	for i := range samples {
+		t := float64(i) / float64(rate)
+		phase := 2 * math.Pi * (f0*t + (f1-f0)*t*t/(2*length.Seconds()))
+		env := 1.0
+		if d := min(i, n-1-i); d < fade {
+			env = 0.5 - 0.5*math.Cos(math.Pi*float64(d)/float64(fade))
+		}
+		samples[i] = 0.5 * env * math.Sin(phase)
+	}
+	return samples
+}
+
+// decibels returns the ratio of a to b in dB
+func decibels(a, b float64) float64 {
+	return 20 * math.Log10(a/b)
+}
+
+// bandEnergy returns the energy of samples at rate below and above split Hz,
+// measured with a Hann windowed FFT over the largest power of two that fits
+func bandEnergy(t *testing.T, samples []float64, rate int, split float64) (below, above float64) {
+	n := 1
+	for n*2 <= len(samples) {
+		n *= 2
+	}
+	plan, err := NewFFTPlan(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	windowed := make([]float64, n)
+	for i, c := range Hann.Coefficients(n) {
+		windowed[i] = samples[i] * c
+	}
+	for k, v := range plan.Real(nil, windowed) {
+		power := real(v)*real(v) + imag(v)*imag(v)
+		if float64(k)*float64(rate)/float64(n) < split {
+			below += power
+		} else {
+			above += power
+		}
+	}
+	return below, above
+}
+
+func TestResampleRejectsAliasing(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to int
+		cutoff   float64
+		// f0 and f1 are a sweep that lies entirely in the stopband
+		f0, f1 float64
+	}{
+		// the 48kHz stream sources, everything above 22.05kHz has to go
+		{"48000 to 44100", 48000, 44100, 0, 22300, 23900},
+		// what STFT does with the DefaultSpectrogramConfig
+		{"44100 to 11025", 44100, 11025, 5000, 5600, 21000},
+		{"48000 to 11025", 48000, 11025, 5000, 5600, 23900},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := sweep(tt.from, tt.f0, tt.f1, 2*time.Second)
+			output, err := Resample(input, tt.from, tt.to, tt.cutoff)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// anything left would alias to below the output nyquist
+			if gain := decibels(rms(output), rms(input)); gain > -70 {
+				t.Errorf("sweep from %vHz to %vHz came through at %.1fdB", tt.f0, tt.f1, gain)
+			}
+		})
+	}
+}
+
+func TestResamplePassband(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to int
+		f0, f1   float64
+	}{
+		{"48000 to 44100", 48000, 44100, 100, 19000},
+		{"22050 to 44100", 22050, 44100, 100, 9500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := sweep(tt.from, tt.f0, tt.f1, 2*time.Second)
+			output, err := Resample(input, tt.from, tt.to, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the power of a signal doesn't depend on the sample rate
+			if gain := decibels(rms(output), rms(input)); math.Abs(gain) > 0.1 {
+				t.Errorf("passband gain is %.2fdB", gain)
+			}
+		})
+	}
+}
+
+func TestResampleRejectsImages(t *testing.T) {
+	// upsampling creates mirror images of the input above its nyquist
+	// frequency, the filter has to remove those
+	input := sweep(22050, 100, 9500, 4*time.Second)
+	output, err := Resample(input, 22050, 44100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	below, above := bandEnergy(t, output, 44100, 11025)
+	if ratio := 10 * math.Log10(above/below); ratio > -70 {
+		t.Errorf("images above 11025Hz are at %.1fdB", ratio)
+	}
+}
+
+func TestResamplerChunks(t *testing.T) {
+	input := sweep(48000, 100, 20000, time.Second)
+	whole, err := Resample(input, 48000, 44100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewResampler(48000, 44100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunked []float64
+	for rest := input; len(rest) > 0; {
+		n := min(len(rest), 997)
+		chunked = r.Process(chunked, rest[:n])
+		rest = rest[n:]
+	}
+	chunked = r.Flush(chunked)
+
+	if len(chunked) != len(whole) {
+		t.Fatalf("chunked output has %d samples, want %d", len(chunked), len(whole))
+	}
+	for i := range whole {
+		if math.Abs(chunked[i]-whole[i]) > 1e-12 {
+			t.Fatalf("sample %d: got %v, want %v", i, chunked[i], whole[i])
+		}
+	}
+}
+
+func TestSpectrogramSameAt48000(t *testing.T) {
+	// the same audio has to give the same spectrogram no matter the rate it
+	// was sampled at, apart from the resampling error
+	song := newSynthSong(1, 5*time.Second)
+	a, err := Spectrogram(song.render(44100, 0, 5*time.Second), 44100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Spectrogram(song.render(48000, 0, 5*time.Second), 48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var diff, total float64
+	for i := range min(len(a), len(b)) {
+		for k := range a[i] {
+			diff += cmplx.Abs(a[i][k] - b[i][k])
+			total += cmplx.Abs(a[i][k])
+		}
+	}
+	if ratio := diff / total; ratio > 0.01 {
+		t.Errorf("spectrograms differ by %.2f%%", ratio*100)
+	}
+}
+
+func TestMatchSameAt48000(t *testing.T) {
+	songs := []synthSong{newSynthSong(1, 40*time.Second), newSynthSong(2, 40*time.Second)}
+	db := indexSongs(t, songs...)
+
+	matcher, err := NewMatcher(db, DefaultSpectrogramConfig, BandPeakExtractor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rate := range []int{44100, 48000} {
+		clip := addNoise(songs[1].render(rate, 15*time.Second, 10*time.Second), 0.05, uint64(rate))
+		matches, _, err := matcher.Find(clip, 10*time.Second, rate)
+		if err != nil {
+			t.Fatalf("%dHz: %v", rate, err)
+		}
+
+		best := matches[0]
+		if best.SongID != 2 {
+			t.Errorf("%dHz: matched song %d, want 2", rate, best.SongID)
+		}
+		if d := best.Offset - 15*time.Second; d < -offsetToleranceMs*time.Millisecond || d > offsetToleranceMs*time.Millisecond {
+			t.Errorf("%dHz: offset is %s, want 15s", rate, best.Offset)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package generator
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FrameFunc is called by STFT for every spectrogram frame in order, idx is the
+// index of the frame in the spectrogram and frame is owned by the callee.
+type FrameFunc func(idx int, frame []complex128) error
+
+// STFT computes a spectrogram incrementally from chunks of samples, the
+// frames it emits are identical to what Spectrogram returns for the same
+// samples in one go.
+type STFT struct {
+	emit FrameFunc
+	cfg  SpectrogramConfig
+
+	resampler *Resampler
+	plan      *FFTPlan
+	window    []float64
+
+	// pending holds resampled samples that are still needed by a frame,
+	// pending[0] is sample number pendingStart of the resampled signal
+	pending      []float64
+	pendingStart int
+	// total is the amount of resampled samples seen so far
+	total int
+	// frames is the amount of frames emitted so far
+	frames int
+
+	// odd holds a trailing byte from ReadFrom that didn't form a full sample
+	odd    []byte
+	bin    []float64
+	closed bool
+}
+
+// NewSTFT returns an STFT using cfg for input at sampleRate that calls emit
+// for every frame produced.
+func NewSTFT(cfg SpectrogramConfig, sampleRate int, emit FrameFunc) (*STFT, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid spectrogram config: %w", err)
+	}
+
+	resampler, err := NewResampler(sampleRate, cfg.SampleRate, cfg.Cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't resample audio samples: %v", err)
+	}
+
+	plan, err := NewFFTPlan(cfg.WindowSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &STFT{
+		emit:      emit,
+		cfg:       cfg,
+		resampler: resampler,
+		plan:      plan,
+		window:    cfg.Window.Coefficients(cfg.WindowSize),
+		bin:       make([]float64, cfg.WindowSize),
+	}, nil
+}
+
+// Write feeds samples into the STFT, frames are emitted as soon as all the
+// samples they need are available.
+func (s *STFT) Write(samples []float64) error {
+	if s.closed {
+		return errors.New("stft: write after flush")
+	}
+
+	s.push(s.resampler.Process(s.pending, samples))
+
+	return s.emitFrames()
+}
+
+// ReadFrom reads s16le PCM from r until EOF and feeds it into the STFT, it
+// does not call Flush.
+func (s *STFT) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var n int64
+	for {
+		copy(buf, s.odd)
+		nn, err := r.Read(buf[len(s.odd):])
+		n += int64(nn)
+		nn += len(s.odd)
+
+		usable := nn &^ 1
+		s.odd = append(s.odd[:0], buf[usable:nn]...)
+		if usable > 0 {
+			samples := make([]float64, usable/2)
+			for i := range samples {
+				samples[i] = float64(int16(binary.LittleEndian.Uint16(buf[i*2:]))) / 32768.0
+			}
+			if werr := s.Write(samples); werr != nil {
+				return n, werr
+			}
+		}
+
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+// Flush processes any buffered samples and emits the remaining frames, no
+// more samples can be written afterwards.
+func (s *STFT) Flush() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	s.push(s.resampler.Flush(s.pending))
+
+	return s.emitFrames()
+}
+
+// push replaces pending with the resampled samples given, which are appended
+// to pending by the resampler
+func (s *STFT) push(pending []float64) {
+	s.total += len(pending) - len(s.pending)
+	s.pending = pending
+}
+
+// emitFrames emits every frame that is complete
+func (s *STFT) emitFrames() error {
+	for s.frames < s.cfg.FrameCount(s.total) {
+		start := s.frames*s.cfg.HopSize - s.pendingStart
+		copy(s.bin, s.pending[start:start+s.cfg.WindowSize])
+
+		// Apply window function
+		for j := range s.window {
+			s.bin[j] *= s.window[j]
+		}
+
+		if err := s.emit(s.frames, s.plan.Real(nil, s.bin)); err != nil {
+			return err
+		}
+		s.frames++
+	}
+
+	// drop the samples no future frame needs anymore, we only do this once
+	// they make up half the buffer to avoid moving memory around on every call
+	if drop := s.frames*s.cfg.HopSize - s.pendingStart; drop > 0 && drop >= len(s.pending)/2 {
+		drop = min(drop, len(s.pending))
+		s.pending = append(s.pending[:0], s.pending[drop:]...)
+		s.pendingStart += drop
+	}
+	return nil
+}
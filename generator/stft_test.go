@@ -0,0 +1,117 @@
+package generator
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+	"testing"
+)
+
+// collectFrames returns an STFT for input at rate that appends every frame to
+// frames, and checks the frames come in order
+func collectFrames(t *testing.T, rate int, frames *[][]complex128) *STFT {
+	t.Helper()
+	stft, err := NewSTFT(DefaultSpectrogramConfig, rate, func(idx int, frame []complex128) error {
+		if idx != len(*frames) {
+			t.Fatalf("got frame %d after %d frames", idx, len(*frames))
+		}
+		*frames = append(*frames, frame)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stft
+}
+
+// equalFrames fails t if got isn't exactly want
+func equalFrames(t *testing.T, got, want [][]complex128) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if len(got[i]) != len(want[i]) {
+			t.Fatalf("frame %d: got %d bins, want %d", i, len(got[i]), len(want[i]))
+		}
+		for j := range want[i] {
+			if got[i][j] != want[i][j] {
+				t.Fatalf("frame %d bin %d: got %v, want %v", i, j, got[i][j], want[i][j])
+			}
+		}
+	}
+}
+
+// oddReader returns reads of random odd sizes, so samples are split between
+// reads
+type oddReader struct {
+	r    *rand.Rand
+	data []byte
+}
+
+func (o *oddReader) Read(p []byte) (int, error) {
+	if len(o.data) == 0 {
+		return 0, io.EOF
+	}
+	n := min(len(p), len(o.data), 2*o.r.IntN(3000)+1)
+	n = copy(p, o.data[:n])
+	o.data = o.data[n:]
+	return n, nil
+}
+
+func TestSTFTWriteMatchesSpectrogram(t *testing.T) {
+	for _, rate := range []int{44100, 48000, 11025} {
+		r := rand.New(rand.NewPCG(uint64(rate), 0x57f7))
+		samples := make([]float64, 7*rate+r.IntN(rate))
+		for i := range samples {
+			samples[i] = r.Float64()*2 - 1
+		}
+
+		want, err := DefaultSpectrogramConfig.Spectrogram(samples, rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got [][]complex128
+		stft := collectFrames(t, rate, &got)
+		for rest := samples; len(rest) > 0; {
+			n := min(len(rest), r.IntN(5000))
+			if err := stft.Write(rest[:n]); err != nil {
+				t.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+		if err := stft.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		equalFrames(t, got, want)
+	}
+}
+
+func TestSTFTReadFromMatchesSpectrogram(t *testing.T) {
+	const rate = 44100
+	r := rand.New(rand.NewPCG(1, 0x57f7))
+	pcm := make([]byte, 2*(5*rate+r.IntN(rate)))
+	for i := 0; i < len(pcm); i += 2 {
+		binary.LittleEndian.PutUint16(pcm[i:], uint16(r.Uint32()))
+	}
+
+	want, err := DefaultSpectrogramConfig.Spectrogram(S16LEToF64LE(pcm), rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]complex128
+	stft := collectFrames(t, rate, &got)
+	n, err := stft.ReadFrom(&oddReader{r, pcm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(pcm)) {
+		t.Errorf("read %d bytes, want %d", n, len(pcm))
+	}
+	if err := stft.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	equalFrames(t, got, want)
+}
@@ -0,0 +1,122 @@
+package generator
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/Wessie/fingerprinter/storage"
+)
+
+// synthSong is a deterministic song of random notes that can be rendered at
+// any sample rate, so the same audio can be produced at 44.1kHz and 48kHz
+type synthSong struct {
+	notes    []synthNote
+	duration time.Duration
+}
+
+type synthNote struct {
+	// start and length are in seconds
+	start, length float64
+	// freqs are the partials of the note in Hz
+	freqs [3]float64
+	amp   float64
+}
+
+// newSynthSong returns a song of duration made of notes picked by seed, a few
+// notes overlap at any time like chords do
+func newSynthSong(seed uint64, duration time.Duration) synthSong {
+	r := rand.New(rand.NewPCG(seed, 0x5eed))
+	song := synthSong{duration: duration}
+
+	for voice := 0; voice < 3; voice++ {
+		for t := r.Float64() * 0.2; t < duration.Seconds(); {
+			note := synthNote{
+				start:  t,
+				length: 0.15 + r.Float64()*0.35,
+				amp:    0.1 + r.Float64()*0.2,
+			}
+			// a fundamental between 100Hz and 1.6kHz with two partials
+			// that aren't harmonics, so every note has its own shape
+			base := 100 * math.Pow(2, r.Float64()*4)
+			note.freqs = [3]float64{base, base * (1.5 + r.Float64()), base * (2.5 + r.Float64()*1.5)}
+			song.notes = append(song.notes, note)
+			t += note.length * (0.6 + r.Float64()*0.6)
+		}
+	}
+	return song
+}
+
+// render returns length of the song starting at from, sampled at rate
+func (s synthSong) render(rate int, from, length time.Duration) []float64 {
+	samples := make([]float64, int(length.Seconds()*float64(rate)))
+	start := from.Seconds()
+	end := start + length.Seconds()
+
+	for _, note := range s.notes {
+		if note.start >= end || note.start+note.length <= start {
+			continue
+		}
+		first := max(0, int(math.Ceil((note.start-start)*float64(rate))))
+		last := min(len(samples), int((note.start+note.length-start)*float64(rate)))
+		for i := first; i < last; i++ {
+			t := start + float64(i)/float64(rate)
+			// a smooth envelope so notes don't click
+			env := math.Sin(math.Pi * (t - note.start) / note.length)
+			for k, freq := range note.freqs {
+				samples[i] += note.amp * env / float64(k+1) * math.Sin(2*math.Pi*freq*t)
+			}
+		}
+	}
+	return samples
+}
+
+// addNoise adds white noise with the RMS level given to samples
+func addNoise(samples []float64, level float64, seed uint64) []float64 {
+	r := rand.New(rand.NewPCG(seed, 0xa015e))
+	for i := range samples {
+		samples[i] += r.NormFloat64() * level
+	}
+	return samples
+}
+
+// rms returns the root mean square of samples
+func rms(samples []float64) float64 {
+	var sum float64
+	for _, v := range samples {
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+// indexSongs fingerprints songs into a new MemoryStorage at 44.1kHz like the
+// CLI does, the songs get IDs starting at 1 in order
+func indexSongs(t testing.TB, songs ...synthSong) *storage.MemoryStorage {
+	t.Helper()
+	db := storage.NewMemoryStorage()
+	if err := CheckVersion(db, DefaultSpectrogramConfig, BandPeakExtractor{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := StoredHashCodec(db, DefaultHashCodec); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, song := range songs {
+		id, err := db.RegisterSong(fmt.Sprintf("key%d", i), fmt.Sprintf("song %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		spectrogram, err := Spectrogram(song.render(44100, 0, song.duration), 44100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peaks := ExtractPeaks(spectrogram, DefaultSpectrogramConfig)
+		if err := db.StoreFingerprints(Fingerprint(peaks, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
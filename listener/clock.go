@@ -0,0 +1,124 @@
+package listener
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// streamClock relates the bytes of a stream to the time of the audio decoded
+// from them, so a position the HTTP reader saw can be found in the audio even
+// if decoding lags behind. It is as accurate as the amount of bytes the
+// decoder buffers.
+type streamClock struct {
+	mu sync.Mutex
+	// read is the amount of bytes the decoder read so far
+	read int64
+	// points are in ascending order, the first one is the start of the
+	// stream until it is forgotten
+	points []clockPoint
+}
+
+// clockPoint is the end of the audio decoded after the decoder read bytes
+type clockPoint struct {
+	bytes int64
+	at    time.Duration
+}
+
+func newStreamClock() *streamClock {
+	return &streamClock{points: []clockPoint{{}}}
+}
+
+// reader returns r counting the bytes read from it, the decoder has to read
+// the stream through it
+func (c *streamClock) reader(r io.Reader) io.Reader {
+	return clockReader{r: r, clock: c}
+}
+
+type clockReader struct {
+	r     io.Reader
+	clock *streamClock
+}
+
+func (cr clockReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.clock.mu.Lock()
+	cr.clock.read += int64(n)
+	cr.clock.mu.Unlock()
+	return n, err
+}
+
+// source returns src recording the time of its audio on the clock
+func (c *streamClock) source(src AudioSource) AudioSource {
+	return clockSource{AudioSource: src, clock: c}
+}
+
+type clockSource struct {
+	AudioSource
+	clock *streamClock
+}
+
+func (cs clockSource) ReadSamples(dst []float64) (int, time.Duration, error) {
+	n, at, err := cs.AudioSource.ReadSamples(dst)
+	if rate := cs.SampleRate(); n > 0 && rate > 0 {
+		cs.clock.record(at + time.Duration(n)*time.Second/time.Duration(rate))
+	}
+	return n, at, err
+}
+
+// record adds a point for the bytes read so far, end is the time of the end
+// of the audio decoded from them
+func (c *streamClock) record(end time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last := c.points[len(c.points)-1]
+	if c.read == last.bytes {
+		c.points[len(c.points)-1].at = max(last.at, end)
+		return
+	}
+	c.points = append(c.points, clockPoint{bytes: c.read, at: max(last.at, end)})
+}
+
+// bytesRead returns the amount of bytes the decoder read so far
+func (c *streamClock) bytesRead() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.read
+}
+
+// timeAt returns the time of the audio decoded from the byte at offset, it
+// returns false if that byte wasn't decoded yet
+func (c *streamClock) timeAt(offset int64) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := 0
+	for i < len(c.points) && c.points[i].bytes < offset {
+		i++
+	}
+	if i == len(c.points) {
+		return 0, false
+	}
+	if i == 0 {
+		return c.points[0].at, true
+	}
+
+	// the bytes between two points are assumed to be of equal length
+	a, b := c.points[i-1], c.points[i]
+	frac := float64(offset-a.bytes) / float64(b.bytes-a.bytes)
+	return a.at + time.Duration(frac*float64(b.at-a.at)), true
+}
+
+// forget drops the points that are no longer needed to find offsets after
+// offset
+func (c *streamClock) forget(offset int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	i := 0
+	for i+1 < len(c.points) && c.points[i+1].bytes <= offset {
+		i++
+	}
+	c.points = append(c.points[:0], c.points[i:]...)
+}
@@ -0,0 +1,85 @@
+package listener
+
+import (
+	"testing"
+	"time"
+)
+
+// decode advances c as if the decoder read n more bytes and decoded the audio
+// up to end from what it read so far
+func decode(c *streamClock, n int64, end time.Duration) {
+	c.read += n
+	c.record(end)
+}
+
+func TestStreamClockTimeAt(t *testing.T) {
+	c := newStreamClock()
+	// the decoder holds back the end of the first read until the second,
+	// and decodes more of it without reading
+	decode(c, 1000, 800*time.Millisecond)
+	decode(c, 0, time.Second)
+	decode(c, 1000, 2*time.Second)
+	// a read that isn't decoded yet
+	c.read += 500
+
+	// titles changing at these offsets
+	tests := []struct {
+		offset int64
+		at     time.Duration
+		ok     bool
+	}{
+		{0, 0, true},
+		{500, 500 * time.Millisecond, true},
+		{1000, time.Second, true},
+		{1250, 1250 * time.Millisecond, true},
+		{2000, 2 * time.Second, true},
+		{2001, 0, false},
+		{2500, 0, false},
+	}
+	for _, tt := range tests {
+		at, ok := c.timeAt(tt.offset)
+		if at != tt.at || ok != tt.ok {
+			t.Errorf("timeAt(%d) = %v, %v, want %v, %v", tt.offset, at, ok, tt.at, tt.ok)
+		}
+	}
+	if n := len(c.points); n != 3 {
+		t.Errorf("got %d points, want 3", n)
+	}
+}
+
+func TestStreamClockForget(t *testing.T) {
+	c := newStreamClock()
+	for i := range int64(4) {
+		decode(c, 1000, time.Duration(i+1)*time.Second)
+	}
+
+	// the point before the offset is kept to find it
+	c.forget(1500)
+	if n := len(c.points); n != 4 {
+		t.Fatalf("got %d points after forgetting up to 1500, want 4", n)
+	}
+	if at, ok := c.timeAt(1500); at != 1500*time.Millisecond || !ok {
+		t.Errorf("timeAt(1500) = %v, %v after forgetting up to it", at, ok)
+	}
+
+	// offsets before the first point are placed at it
+	c.forget(2000)
+	if n := len(c.points); n != 3 {
+		t.Fatalf("got %d points after forgetting up to 2000, want 3", n)
+	}
+	if at, ok := c.timeAt(1500); at != 2*time.Second || !ok {
+		t.Errorf("timeAt(1500) = %v, %v after forgetting it", at, ok)
+	}
+
+	// the last point is never forgotten
+	c.forget(10000)
+	if n := len(c.points); n != 1 {
+		t.Fatalf("got %d points after forgetting everything, want 1", n)
+	}
+	if at, ok := c.timeAt(4000); at != 4*time.Second || !ok {
+		t.Errorf("timeAt(4000) = %v, %v after forgetting everything", at, ok)
+	}
+	if _, ok := c.timeAt(4001); ok {
+		t.Error("timeAt(4001) is known before it is decoded")
+	}
+}
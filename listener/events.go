@@ -0,0 +1,126 @@
+package listener
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Wessie/fingerprinter/generator"
+)
+
+// Event is something that happened while listening to a stream, it is one of
+// WindowMatched, SongIdentified, MetadataChanged, Disagreement or Disconnected
+type Event interface {
+	// Header returns the fields every event has
+	Header() EventHeader
+}
+
+// EventHeader is embedded in every event
+type EventHeader struct {
+	// Time is the wall clock time the event happened at
+	Time time.Time
+	// At is the position in the stream the event is about, measured from the
+	// start of the first connection
+	At time.Duration
+}
+
+func (h EventHeader) Header() EventHeader {
+	return h
+}
+
+// WindowMatched is sent for every window of audio once it has been matched,
+// in the order of the audio. At is the time of the first sample of the window.
+type WindowMatched struct {
+	EventHeader
+	// Title is the title that was current in the middle of the window
+	Title string
+	// SampleOffset is the amount of samples in the stream before the window
+	SampleOffset int64
+	// Matches are the songs that matched the window, best first. Confident
+	// reports whether the best one reached the minimum confidence, if it
+	// didn't these are just the candidates.
+	Matches   []generator.Match
+	Confident bool
+	// Took is how long matching the window took
+	Took time.Duration
+	// Err is set if matching failed, Matches is empty in that case
+	Err error
+}
+
+// Best returns the best match and whether it was confident
+func (e WindowMatched) Best() (generator.Match, bool) {
+	if len(e.Matches) == 0 {
+		return generator.Match{}, false
+	}
+	return e.Matches[0], e.Confident
+}
+
+// SongIdentified is sent when the audio reaches the end of a title or a lost
+// connection, with the song that scored highest in the windows attributed to
+// the title since its start or the last lost connection. It is also sent for
+// the current title when the listener stops.
+type SongIdentified struct {
+	EventHeader
+	Identification
+}
+
+// Identification is the song a stream most likely played while a title was
+// announced
+type Identification struct {
+	// Title is the announced StreamTitle, empty for audio before the first
+	// title
+	Title string
+	// SongID and Metadata are of the song that scored highest
+	SongID   uint32
+	Metadata string
+	// Score is the sum of the scores of the song over all windows
+	Score float64
+	// Confidence is the highest confidence the song was matched with
+	Confidence float64
+	// Windows is the amount of windows the song was confidently matched in
+	Windows int
+	// Start and End are the stream positions of the first and last window
+	// the song was matched in
+	Start, End time.Duration
+	// Offset is the position in the song the last window started at
+	Offset time.Duration
+}
+
+// MetadataChanged is sent when the audio reaches the point a new title was
+// announced at. Time is when the title was received, which is usually before
+// the audio was decoded.
+type MetadataChanged struct {
+	EventHeader
+	Title    string
+	Previous string
+	// ByteOffset is the amount of audio bytes in the stream before the title
+	// and SampleOffset the amount of samples decoded from them
+	ByteOffset   int64
+	SampleOffset int64
+}
+
+// Disagreement is sent after SongIdentified if the identified song doesn't
+// look like the announced title
+type Disagreement struct {
+	EventHeader
+	Identification
+}
+
+// Disconnected is sent when the audio reaches the point the connection to the
+// stream was lost, after the song identified for the audio before it. The
+// listener reconnects by itself and the title goes on until another is
+// announced.
+type Disconnected struct {
+	EventHeader
+	Err error
+}
+
+// titleMatches reports whether the metadata of a song looks like the
+// announced title
+func titleMatches(title, metadata string) bool {
+	title = strings.ToLower(strings.TrimSpace(title))
+	metadata = strings.ToLower(strings.TrimSpace(metadata))
+	if title == "" || metadata == "" {
+		return title == metadata
+	}
+	return strings.HasPrefix(metadata, title) || strings.HasPrefix(title, metadata)
+}
@@ -0,0 +1,161 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Wessie/fingerprinter/generator"
+	"github.com/Wessie/fingerprinter/listener/icecasttest"
+)
+
+// pcmRate is the sample rate of the PCM tracks the event tests stream
+const pcmRate = 8000
+
+// pcmTrack returns a track of mono PCM at pcmRate with every sample at level
+func pcmTrack(title string, length time.Duration, level float64) icecasttest.Track {
+	samples := make([]float64, int(length.Seconds()*pcmRate))
+	for i := range samples {
+		samples[i] = level
+	}
+	return icecasttest.Track{Title: title, Data: encodeS16LE(nil, samples)}
+}
+
+// levelMatcher identifies windows by the level of their first sample, it
+// returns an error for silence
+type levelMatcher map[float64]generator.Match
+
+var errSilence = errors.New("silence")
+
+func (lm levelMatcher) Find(samples []float64, duration time.Duration, sampleRate int) ([]generator.Match, time.Duration, error) {
+	match, ok := lm[samples[0]]
+	if !ok {
+		return nil, 0, errSilence
+	}
+	return []generator.Match{match}, time.Millisecond, nil
+}
+
+// runEvents runs a StreamListener with matcher on server until stop returns
+// true for an event, and returns the events up to that one
+func runEvents(t *testing.T, server *icecasttest.Server, matcher WindowMatcher, stop func(Event) bool) []Event {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var mu sync.Mutex
+	var events []Event
+	sl := NewStreamListener(server.URL, matcher)
+	sl.NewSource = func(r io.Reader) (AudioSource, error) {
+		return NewPCMSource(r, pcmRate, 1), nil
+	}
+	sl.Window = time.Second
+	sl.Events = func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		events = append(events, e)
+		if stop(e) {
+			cancel()
+		}
+	}
+	if err := sl.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("run stopped with %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	return events
+}
+
+func TestStreamListenerEvents(t *testing.T) {
+	// "b" is announced but the song sounds like "c", and the last track is
+	// silence the matcher fails on
+	server := icecasttest.NewServer(
+		pcmTrack("a", 2*time.Second, 0.25),
+		pcmTrack("b", 2*time.Second, -0.25),
+		pcmTrack("end", time.Second, 0),
+	)
+	defer server.Close()
+	server.MetaInt = 160
+
+	matcher := levelMatcher{
+		0.25:  {SongID: 1, Metadata: "a", Score: 10, Confidence: 1},
+		-0.25: {SongID: 2, Metadata: "c", Score: 10, Confidence: 1},
+	}
+	// the stream ends after the silence
+	events := runEvents(t, server, matcher, func(e Event) bool {
+		_, ok := e.(Disconnected)
+		return ok
+	})
+
+	var identified []SongIdentified
+	var disagreements []Disagreement
+	var failed []WindowMatched
+	var disconnected []Disconnected
+	for _, e := range events {
+		switch e := e.(type) {
+		case SongIdentified:
+			identified = append(identified, e)
+		case Disagreement:
+			disagreements = append(disagreements, e)
+		case WindowMatched:
+			if e.Err != nil {
+				failed = append(failed, e)
+			}
+		case Disconnected:
+			disconnected = append(disconnected, e)
+		}
+	}
+
+	// a title is late by up to MetaInt bytes, which is 10ms at pcmRate
+	const tolerance = 10 * time.Millisecond
+	want := []struct {
+		title, metadata string
+		at              time.Duration
+	}{
+		{"a", "a", 2 * time.Second},
+		{"b", "c", 4 * time.Second},
+	}
+	if len(identified) != len(want) {
+		t.Fatalf("got %d songs identified, want %d: %+v", len(identified), len(want), identified)
+	}
+	for i, w := range want {
+		got := identified[i]
+		if got.Title != w.title || got.Metadata != w.metadata || got.At < w.at || got.At > w.at+tolerance || got.Confidence != 1 {
+			t.Errorf("song %d: got %q as %q at %v with confidence %v, want %q as %q at %v",
+				i, got.Title, got.Metadata, got.At, got.Confidence, w.title, w.metadata, w.at)
+		}
+	}
+
+	if len(disagreements) != 1 {
+		t.Fatalf("got %d disagreements, want 1", len(disagreements))
+	}
+	if d := disagreements[0]; d.Title != "b" || d.Metadata != "c" || d.At != identified[1].At {
+		t.Errorf("got disagreement on %q as %q at %v", d.Title, d.Metadata, d.At)
+	}
+
+	if len(failed) == 0 {
+		t.Fatal("no window failed to match")
+	}
+	for _, w := range failed {
+		if !errors.Is(w.Err, errSilence) || w.Title != "end" || len(w.Matches) > 0 || w.Confident {
+			t.Errorf("failed window at %v: %+v", w.At, w)
+		}
+	}
+
+	// the disconnect comes in the order of the audio, at its end
+	if len(disconnected) != 1 {
+		t.Fatalf("got %d disconnects, want 1", len(disconnected))
+	}
+	if d := disconnected[0]; d.Err == nil || d.At < 5*time.Second-tolerance || d.At > 5*time.Second {
+		t.Errorf("disconnected at %v with %v, want 5s", d.At, d.Err)
+	}
+	if last := failed[len(failed)-1]; last.At >= disconnected[0].At {
+		t.Errorf("window at %v came before the disconnect at %v", last.At, disconnected[0].At)
+	}
+}
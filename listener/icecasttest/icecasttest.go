@@ -0,0 +1,143 @@
+// Package icecasttest provides a fake icecast server to test listeners against
+package icecasttest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMetaInt is the amount of audio bytes between metadata blocks icecast
+// uses by default
+const DefaultMetaInt = 16000
+
+// maxMetadataLength is the longest metadata block the length byte allows
+const maxMetadataLength = 255 * 16
+
+// Track is a part of the stream and the title announced for it
+type Track struct {
+	// Title is sent as StreamTitle in the first metadata block after the
+	// track starts, like icecast this can be up to MetaInt bytes late. The
+	// titles of tracks shorter than that are sent in the blocks after it, one
+	// per block, so none are lost.
+	Title string
+	// Data is the audio of the track, usually MP3 frames
+	Data []byte
+}
+
+// Server streams its tracks to every client that connects, with interleaved
+// metadata if the client asks for it. The connection is closed after the last
+// track.
+type Server struct {
+	*httptest.Server
+	// MetaInt is the amount of audio bytes between metadata blocks
+	MetaInt int
+	// ByteRate is the amount of audio bytes sent per second, the audio is
+	// sent as fast as the client reads it if zero
+	ByteRate int
+	Tracks   []Track
+
+	requests atomic.Int64
+}
+
+// NewServer starts a server streaming tracks
+func NewServer(tracks ...Track) *Server {
+	s := &Server{MetaInt: DefaultMetaInt, Tracks: tracks}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// Requests returns the amount of clients that connected so far
+func (s *Server) Requests() int {
+	return int(s.requests.Load())
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+
+	metaint := 0
+	if r.Header.Get("Icy-MetaData") == "1" {
+		metaint = s.MetaInt
+		w.Header().Set("icy-metaint", strconv.Itoa(metaint))
+	}
+	w.Header().Set("Content-Type", "audio/mpeg")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	write := func(b []byte) bool {
+		if _, err := w.Write(b); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return r.Context().Err() == nil
+	}
+
+	start := time.Now()
+	var sent int64
+	writeAudio := func(b []byte) bool {
+		if s.ByteRate > 0 {
+			// wait until the audio sent so far has had time to play
+			due := start.Add(time.Duration(sent) * time.Second / time.Duration(s.ByteRate))
+			select {
+			case <-time.After(time.Until(due)):
+			case <-r.Context().Done():
+				return false
+			}
+		}
+		sent += int64(len(b))
+		return write(b)
+	}
+
+	// until is the amount of audio bytes left before the next metadata block
+	until := metaint
+	// titles are the titles waiting for a metadata block, in order
+	var titles [][]byte
+	for _, track := range s.Tracks {
+		titles = append(titles, Metadata(track.Title))
+
+		data := track.Data
+		for len(data) > 0 {
+			n := min(until, len(data))
+			if metaint == 0 {
+				// keep the writes small so the pacing stays smooth
+				n = min(DefaultMetaInt, len(data))
+			}
+			if !writeAudio(data[:n]) {
+				return
+			}
+			data, until = data[n:], until-n
+			if metaint == 0 || until > 0 {
+				continue
+			}
+
+			block := []byte{0}
+			if len(titles) > 0 {
+				block, titles = titles[0], titles[1:]
+			}
+			if !write(block) {
+				return
+			}
+			until = metaint
+		}
+	}
+}
+
+// Metadata returns the metadata block announcing title as it's sent on the
+// wire, including the length byte
+func Metadata(title string) []byte {
+	meta := fmt.Sprintf("StreamTitle='%s';", title)
+	if len(meta) > maxMetadataLength {
+		meta = meta[:maxMetadataLength]
+	}
+
+	length := (len(meta) + 15) / 16
+	block := make([]byte, 1+length*16)
+	block[0] = byte(length)
+	copy(block[1:], meta)
+	return block
+}
@@ -0,0 +1,66 @@
+package icecasttest
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readTitles reads the stream of s to the end and returns the titles in its
+// metadata blocks
+func readTitles(t *testing.T, s *Server) []string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Icy-MetaData", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	metaint, err := strconv.Atoi(resp.Header.Get("icy-metaint"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var titles []string
+	r := bufio.NewReader(resp.Body)
+	for {
+		if _, err := io.CopyN(io.Discard, r, int64(metaint)); err != nil {
+			return titles
+		}
+		length, err := r.ReadByte()
+		if err != nil {
+			return titles
+		}
+		block := make([]byte, int(length)*16)
+		if _, err := io.ReadFull(r, block); err != nil {
+			t.Fatal(err)
+		}
+		if length > 0 {
+			meta := strings.TrimRight(string(block), "\x00")
+			titles = append(titles, strings.TrimSuffix(strings.TrimPrefix(meta, "StreamTitle='"), "';"))
+		}
+	}
+}
+
+func TestShortTracksKeepTheirTitles(t *testing.T) {
+	s := NewServer(
+		Track{Title: "a", Data: make([]byte, 30)},
+		Track{Title: "b", Data: make([]byte, 30)},
+		Track{Title: "c", Data: make([]byte, 1000)},
+	)
+	defer s.Close()
+	s.MetaInt = 100
+
+	titles := readTitles(t, s)
+	if want := []string{"a", "b", "c"}; strings.Join(titles, ",") != strings.Join(want, ",") {
+		t.Errorf("got titles %q, want %q", titles, want)
+	}
+}
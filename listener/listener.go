@@ -2,10 +2,7 @@ package listener
 
 import (
 	"bufio"
-	"bytes"
 	"context"
-	"crypto/sha1"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"html"
@@ -15,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,7 +20,7 @@ import (
 	"unicode/utf8"
 
 	"github.com/Wessie/fingerprinter/generator"
-	"github.com/drgolem/go-mpg123/mpg123"
+	"github.com/Wessie/fingerprinter/storage"
 	"github.com/jfreymuth/pulse"
 	"github.com/jfreymuth/pulse/proto"
 	"github.com/rs/zerolog"
@@ -30,36 +28,110 @@ import (
 
 const maxMetadataLength = 255 * 16
 
-func ListenAndMatch(ctx context.Context, matcher *generator.Matcher) error {
+// readFull reads samples from src until dst is full, it returns the time of
+// the first sample
+func readFull(src AudioSource, dst []float64) (time.Duration, error) {
+	var start time.Duration
+	for n := 0; n < len(dst); {
+		nn, at, err := src.ReadSamples(dst[n:])
+		if n == 0 {
+			start = at
+		}
+		n += nn
+		if err != nil {
+			return start, err
+		}
+	}
+	return start, nil
+}
+
+// matchLoop reads windows of audio from src and calls match with each of
+// them and the time of its first sample, consecutive windows overlap by half.
+// match is called from the loop so it has to return quickly.
+func matchLoop(src AudioSource, window time.Duration, match func(samples []float64, at time.Duration)) error {
+	var buf []float64
+	var start time.Duration
+	var rate int
 
-	decoder, err := mpg123.NewDecoder("")
+	for {
+		if rate != src.SampleRate() {
+			// start over if the rate changes, the windows would have
+			// the wrong length otherwise
+			rate = src.SampleRate()
+			buf = make([]float64, int(window.Seconds()*float64(rate)))
+
+			var err error
+			if start, err = readFull(src, buf[:len(buf)/2]); err != nil {
+				return err
+			}
+		}
+
+		half := len(buf) / 2
+		if _, err := readFull(src, buf[half:]); err != nil {
+			return err
+		}
+
+		match(slices.Clone(buf), start)
+
+		copy(buf, buf[half:])
+		start += time.Duration(half) * time.Second / time.Duration(rate)
+	}
+}
+
+// ListenAndMatch matches the stream at STREAM_ENDPOINT against the songs in db
+// and plays it back, a verdict on the metadata of every song is stored in db
+func ListenAndMatch(ctx context.Context, db storage.Storage) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	matcher, err := generator.NewMatcher(db, generator.DefaultSpectrogramConfig, generator.BandPeakExtractor{})
 	if err != nil {
 		return err
 	}
-	defer decoder.Delete()
 
-	// force output format
-	decoder.FormatNone()
-	decoder.Format(44100, 1, mpg123.ENC_SIGNED_16)
+	endpoint := os.Getenv("STREAM_ENDPOINT")
+	reconciler := NewReconciler(db, endpoint)
 
-	// open the decoder to Feed calls
-	if err = decoder.OpenFeed(); err != nil {
-		return err
+	logVerdict := func(v storage.Verdict, ok bool, err error) {
+		if err != nil {
+			log.Println(err)
+		} else if ok {
+			log.Printf("%s: %q was %q", v.Outcome, v.Title, v.Metadata)
+		}
 	}
 
-	// start the listener
-	ln, err := Listen(ctx, os.Getenv("STREAM_ENDPOINT"), func(ctx context.Context, data []byte) error {
-		return decoder.Feed(data)
-	})
-	if err != nil {
-		return err
+	sl := NewStreamListener(endpoint, matcher)
+	sl.Playback = PulsePlayback(ctx)
+	sl.Events = func(e Event) {
+		logVerdict(reconciler.Handle(e))
+
+		switch e := e.(type) {
+		case SongIdentified:
+			log.Println("song is probably:")
+			log.Println("\t", e.Score, e.Metadata)
+		case Disagreement:
+			log.Printf("%q was announced but sounded like %q", e.Title, e.Metadata)
+		case WindowMatched:
+			if e.Err != nil {
+				log.Println(e.Err)
+			}
+		}
 	}
-	defer ln.Close()
+	err = sl.Run(ctx)
+	// the title playing when the listener stopped never ended
+	logVerdict(reconciler.Flush(time.Now()))
+	return err
+}
 
-	// playback audio for testing if it's badly borked
+// PulsePlayback returns a Playback for StreamListener that plays the audio
+// through pulseaudio until ctx is canceled, for testing if it's badly borked.
+// Samples are dropped if pulseaudio can't keep up.
+func PulsePlayback(ctx context.Context) func(samples []float64, sampleRate int) {
 	feed := make(chan []byte, 12)
-	log.Println("new client")
-	go func() {
+	var once sync.Once
+
+	start := func(rate int) {
+		log.Println("new client")
 		c, err := pulse.NewClient()
 		if err != nil {
 			log.Println(err)
@@ -67,7 +139,6 @@ func ListenAndMatch(ctx context.Context, matcher *generator.Matcher) error {
 		}
 		defer c.Close()
 
-		log.Println(decoder.GetFormat())
 		log.Println("playback")
 
 		var data []byte
@@ -83,7 +154,7 @@ func ListenAndMatch(ctx context.Context, matcher *generator.Matcher) error {
 			n := copy(out, data)
 			data = data[n:]
 			return n, nil
-		}), pulse.PlaybackMono, pulse.PlaybackSampleRate(44100))
+		}), pulse.PlaybackMono, pulse.PlaybackSampleRate(rate))
 		if err != nil {
 			log.Println(err)
 			return
@@ -93,143 +164,40 @@ func ListenAndMatch(ctx context.Context, matcher *generator.Matcher) error {
 		stream.Start()
 		<-ctx.Done()
 		stream.Drain()
-	}()
-	// end playback
-
-	var current string
-	// setup result matching at end of songs
-	var resultMu sync.Mutex
-	var result = map[string]float64{}
-	var previousTimestamps = map[uint32]uint32{}
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-			case metadata := <-ln.metadataCh:
-				resultMu.Lock()
-				current = metadata
-				var highest float64
-				var highestMetadata string
-				for metadata, score := range result {
-					if highest < score {
-						highest = score
-						highestMetadata = metadata
-					}
-				}
-				clear(result)
-				resultMu.Unlock()
-
-				log.Println("song is probably:")
-				log.Println("\t", highest, highestMetadata)
-			}
-		}
-	}()
-
-	const amountOfSeconds = 20
-	// 10 seconds of audio
-	buf := make([]byte, 44100*2*amountOfSeconds)
-
-	readFull := func(ctx context.Context, out []byte) error {
-		var n int
-		for n < len(out) && ctx.Err() == nil {
-			var nn int
-			nn, err := decoder.Read(out[n:])
-			if err != nil {
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				case <-time.After(time.Second):
-				}
-			}
-			n += nn
-		}
-		return nil
 	}
 
-	var half = len(buf) / 2
+	return func(samples []float64, sampleRate int) {
+		once.Do(func() { go start(sampleRate) })
 
-	// initialize the first half of the buffer
-	err = readFull(ctx, buf[:half])
-	if err != nil {
-		return err
-	}
-
-	for ctx.Err() == nil {
-		// we want to fill the whole buffer and then slap it to the fingerprinter
-		err = readFull(ctx, buf[half:])
-		if err != nil {
-			return err
+		select {
+		case feed <- encodeS16LE(nil, samples):
+		default:
 		}
-
-		first := sha1.Sum(buf[:half])
-		second := sha1.Sum(buf[half:])
-
-		fmt.Println(hex.EncodeToString(first[:]), hex.EncodeToString(second[:]))
-
-		feed <- bytes.Clone(buf[half:])
-
-		go func(fbuf []float64) {
-			matches, took, err := matcher.Find(fbuf, time.Second*amountOfSeconds, 44100)
-			fmt.Println(took)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			resultMu.Lock()
-			for i, match := range matches {
-				_ = i
-
-				delta := int64(match.Timestamp) - int64(previousTimestamps[match.SongID])
-				if delta > (amountOfSeconds/2-2)*1000 && delta < (amountOfSeconds/2+2)*1000 {
-					match.Score *= 2
-				}
-
-				if i < 100 {
-					fmt.Println(i, match.Score, match.Metadata)
-				}
-				if strings.HasPrefix(match.Metadata, current) {
-					fmt.Println(i, match.Score, match.Timestamp, delta, match.Metadata)
-				}
-				/*if i < 25 {
-					fmt.Println(match.Score, "|", delta, match.Timestamp, "|", match.Metadata)
-				}*/
-
-				previousTimestamps[match.SongID] = match.Timestamp
-				result[match.Metadata] = result[match.Metadata] + match.Score
-			}
-			resultMu.Unlock()
-		}(generator.S16LEToF64LE(buf))
-
-		copy(buf, buf[half:])
 	}
-
-	return ctx.Err()
 }
 
 func Execute(ctx context.Context) error {
-	log.Println("making decoder")
-	decoder, err := mpg123.NewDecoder("")
-	if err != nil {
-		return err
-	}
-	defer decoder.Delete()
-
-	decoder.FormatNone()
-	decoder.Format(44100, 1, mpg123.ENC_SIGNED_16)
-
-	if err = decoder.OpenFeed(); err != nil {
-		return err
-	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	ln, err := Listen(ctx, os.Getenv("STREAM_ENDPOINT"), func(ctx context.Context, data []byte) error {
-		//fmt.Println("write data:", len(data))
-		return decoder.Feed(data)
-	})
+	log.Println("making decoder")
+	ln, src, _, err := NewStreamListener(os.Getenv("STREAM_ENDPOINT"), nil).listen(ctx)
 	if err != nil {
 		return err
 	}
 	defer ln.Close()
+	defer src.Close()
+
+	// nothing uses the titles, but the listener waits for them to be taken
+	go func() {
+		for {
+			select {
+			case <-ln.metadataCh:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
 	log.Println("new client")
 	c, err := pulse.NewClient()
@@ -238,21 +206,20 @@ func Execute(ctx context.Context) error {
 	}
 	defer c.Close()
 
-	log.Println(decoder.GetFormat())
 	log.Println("playback")
+	var samples []float64
 	stream, err := c.NewPlayback(NewFormatReader(proto.FormatInt16LE, func(out []byte) (int, error) {
 		//		log.Println("data ask")
-		n, err := decoder.Read(out)
+		samples = slices.Grow(samples[:0], len(out)/2)[:len(out)/2]
+		n, _, err := src.ReadSamples(samples)
 		if err != nil && n == 0 {
-			time.Sleep(time.Second / 2)
 			log.Println("data err:", err)
-			return 0, nil
+			return 0, err
 		}
 
-		//log.Println(decoder.GetFormat())
 		//log.Println("data written", n)
-		return n, nil
-	}), pulse.PlaybackMono, pulse.PlaybackSampleRate(44100))
+		return len(encodeS16LE(out[:0], samples[:n])), nil
+	}), pulse.PlaybackMono, pulse.PlaybackSampleRate(src.SampleRate()))
 	if err != nil {
 		return err
 	}
@@ -297,8 +264,28 @@ type listener struct {
 	// cancel is called when Close is called and cancels all in-progress reads
 	cancel     context.CancelFunc
 	done       chan struct{}
+	client     *http.Client
 	handleData func(ctx context.Context, data []byte) error
-	metadataCh chan string
+	// metadataCh receives every title in the order they're announced and
+	// every lost connection if not nil, the listener waits for each to be
+	// received before passing on more audio
+	metadataCh chan metadataChange
+	// offset is the amount of audio bytes passed to handleData so far, over
+	// all connections
+	offset int64
+}
+
+// metadataChange is a title announced in the stream
+type metadataChange struct {
+	Title string
+	// Offset is the amount of audio bytes that came before the title, the
+	// title is of the audio from there on
+	Offset int64
+	// Time is when the title was received
+	Time time.Time
+	// Err is set if this isn't a title but the connection was lost with it
+	// after Offset bytes, Title is empty then
+	Err error
 }
 
 func Listen(ctx context.Context, u string, dataFn func(ctx context.Context, data []byte) error) (*listener, error) {
@@ -309,8 +296,13 @@ func Listen(ctx context.Context, u string, dataFn func(ctx context.Context, data
 	return ListenURL(ctx, uri, dataFn), nil
 }
 func ListenURL(ctx context.Context, u *url.URL, dataFn func(ctx context.Context, data []byte) error) *listener {
+	return listenURL(ctx, http.DefaultClient, u, dataFn, nil)
+}
+
+func listenURL(ctx context.Context, client *http.Client, u *url.URL, dataFn func(ctx context.Context, data []byte) error, metadataCh chan metadataChange) *listener {
 	ln := listener{
-		metadataCh: make(chan string),
+		client:     client,
+		metadataCh: metadataCh,
 		done:       make(chan struct{}),
 		handleData: dataFn,
 	}
@@ -348,9 +340,20 @@ func (ln *listener) run(ctx context.Context, u *url.URL) {
 			continue
 		}
 		err = ln.parseResponse(ctx, metasize, conn)
-		if err != nil {
+		conn.Close()
+		if err != nil && ctx.Err() == nil {
 			// log the error, and try reconnecting
 			logger.Error().Err(err).Msg("connection")
+			if ln.metadataCh == nil {
+				continue
+			}
+			// the disconnect goes with the titles, so it's placed on the
+			// audio like them
+			select {
+			case ln.metadataCh <- metadataChange{Offset: ln.offset, Time: time.Now(), Err: err}:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}
 }
@@ -365,8 +368,7 @@ func (ln *listener) newConn(ctx context.Context, u *url.URL) (io.ReadCloser, int
 	// we want interleaved metadata so we have to ask for it
 	req.Header.Add("Icy-MetaData", "1")
 	req.Header.Set("User-Agent", "hanyuu/relay")
-	// TODO: don't use the default client
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := ln.client.Do(req)
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to do request: %w", err)
 	}
@@ -404,6 +406,7 @@ func (ln *listener) parseResponse(ctx context.Context, metasize int, src io.Read
 				logger.Err(err).Msg("failed handling mp3 data")
 			}
 		}
+		ln.offset += int64(metasize)
 		// then we get a single byte indicating metadata length
 		b, err := r.ReadByte()
 		if err != nil {
@@ -415,7 +418,7 @@ func (ln *listener) parseResponse(ctx context.Context, metasize int, src io.Read
 			continue
 		}
 		// else metadata length needs to be multiplied by 16 from the wire
-		length := int(b * 16)
+		length := int(b) * 16
 		_, err = io.ReadFull(r, buf[:length])
 		if err != nil {
 			return err
@@ -432,12 +435,16 @@ func (ln *listener) parseResponse(ctx context.Context, metasize int, src io.Read
 			logger.Info().Msg("empty metadata")
 			continue
 		}
-		go func() {
-			select {
-			case ln.metadataCh <- song:
-			case <-ctx.Done():
-			}
-		}()
+		if ln.metadataCh == nil {
+			continue
+		}
+		// this waits so the audio after the title isn't passed on before
+		// the title itself
+		select {
+		case ln.metadataCh <- metadataChange{Title: song, Offset: ln.offset, Time: time.Now()}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
 func parseMetadata(b []byte) map[string]string {
@@ -0,0 +1,124 @@
+package listener
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Wessie/fingerprinter/generator"
+	"github.com/Wessie/fingerprinter/storage"
+)
+
+// Reconciler compares every title a station announces with the song that was
+// identified while it was current and stores the verdict, so the quality of
+// the metadata of a station can be audited
+type Reconciler struct {
+	db      storage.Storage
+	station string
+	// MinConfidence is the confidence an identification needs, the outcome
+	// is unknown below it
+	MinConfidence float64
+
+	mu sync.Mutex
+	// title is the current title and start when it was announced, started
+	// is false until the first title
+	title   string
+	start   time.Time
+	started bool
+	// identified is the song identified for title, nil if there is none
+	identified *Identification
+	// resumed is set when the connection was lost during title, the audio
+	// after it is only judged if a song is identified in it
+	resumed bool
+}
+
+// NewReconciler returns a reconciler storing verdicts for station in db
+func NewReconciler(db storage.Storage, station string) *Reconciler {
+	return &Reconciler{
+		db:            db,
+		station:       station,
+		MinConfidence: generator.DefaultMinConfidence,
+	}
+}
+
+// Handle takes the events of a StreamListener in order, when a title ends it
+// stores and returns the verdict for it. A lost connection ends the audio of a
+// title, it's judged up to there and again for the audio after the reconnect.
+func (r *Reconciler) Handle(e Event) (storage.Verdict, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch e := e.(type) {
+	case SongIdentified:
+		if r.started && e.Title == r.title {
+			r.identified = &e.Identification
+		}
+	case MetadataChanged:
+		v, ok := r.verdict(e.Time)
+		r.title, r.start, r.started, r.identified, r.resumed = e.Title, e.Time, true, nil, false
+		return r.store(v, ok)
+	case Disconnected:
+		v, ok := r.verdict(e.Time)
+		r.start, r.identified, r.resumed = e.Time, nil, true
+		return r.store(v, ok)
+	}
+	return storage.Verdict{}, false, nil
+}
+
+// Flush ends the current title at end and stores and returns the verdict for
+// it, it is called when the listener stops. The title after it is only judged
+// from the next title change on.
+func (r *Reconciler) Flush(end time.Time) (storage.Verdict, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.flush(end)
+}
+
+// flush is Flush, the caller has to hold mu
+func (r *Reconciler) flush(end time.Time) (storage.Verdict, bool, error) {
+	v, ok := r.verdict(end)
+	r.title, r.started, r.identified, r.resumed = "", false, nil, false
+	return r.store(v, ok)
+}
+
+// store stores v if ok
+func (r *Reconciler) store(v storage.Verdict, ok bool) (storage.Verdict, bool, error) {
+	if !ok {
+		return v, false, nil
+	}
+
+	id, err := r.db.StoreVerdict(v)
+	if err != nil {
+		return v, false, fmt.Errorf("error storing verdict: %w", err)
+	}
+	v.ID = id
+	return v, true, nil
+}
+
+// verdict returns the verdict for the current title if it ended at end, the
+// caller has to hold mu
+func (r *Reconciler) verdict(end time.Time) (storage.Verdict, bool) {
+	if !r.started || r.title == "" || (r.resumed && r.identified == nil) {
+		return storage.Verdict{}, false
+	}
+
+	v := storage.Verdict{
+		Station: r.station,
+		Title:   r.title,
+		Outcome: storage.OutcomeUnknown,
+		Start:   r.start,
+		End:     end,
+	}
+
+	id := r.identified
+	if id == nil || id.Confidence < r.MinConfidence {
+		return v, true
+	}
+
+	v.SongID, v.Metadata, v.Confidence = id.SongID, id.Metadata, id.Confidence
+	v.Outcome = storage.OutcomeMismatch
+	if titleMatches(r.title, id.Metadata) {
+		v.Outcome = storage.OutcomeAgreement
+	}
+	return v, true
+}
@@ -0,0 +1,68 @@
+package listener
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Wessie/fingerprinter/listener/icecasttest"
+	"github.com/Wessie/fingerprinter/storage"
+)
+
+func TestReconcilerAcrossDisconnects(t *testing.T) {
+	// the connection is lost in the middle of "a" and the stream goes on
+	// with it after the reconnect, announcing it again
+	server := icecasttest.NewServer(pcmTrack("a", 3*time.Second, 0.25))
+	defer server.Close()
+	server.MetaInt = 160
+
+	matcher := levelMatcher{
+		0.25: {SongID: 1, Metadata: "a", Score: 10, Confidence: 1},
+	}
+	disconnects := 0
+	events := runEvents(t, server, matcher, func(e Event) bool {
+		if _, ok := e.(Disconnected); ok {
+			disconnects++
+		}
+		return disconnects == 2
+	})
+
+	db := storage.NewMemoryStorage()
+	r := NewReconciler(db, "station")
+	var changed MetadataChanged
+	var disconnected []Disconnected
+	for _, e := range events {
+		if _, _, err := r.Handle(e); err != nil {
+			t.Fatal(err)
+		}
+		switch e := e.(type) {
+		case MetadataChanged:
+			changed = e
+		case Disconnected:
+			disconnected = append(disconnected, e)
+		}
+	}
+
+	// nothing was identified after the last reconnect
+	if v, ok, err := r.Flush(time.Now()); err != nil || ok {
+		t.Errorf("flush stored %+v, %v", v, err)
+	}
+
+	verdicts, err := db.ListVerdicts(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []storage.Verdict{
+		{Title: "a", SongID: 1, Outcome: storage.OutcomeAgreement, Start: changed.Time, End: disconnected[0].Time},
+		{Title: "a", SongID: 1, Outcome: storage.OutcomeAgreement, Start: disconnected[0].Time, End: disconnected[1].Time},
+	}
+	if len(verdicts) != len(want) {
+		t.Fatalf("got %d verdicts, want %d: %+v", len(verdicts), len(want), verdicts)
+	}
+	for i, w := range want {
+		got := verdicts[i]
+		if got.Station != "station" || got.Title != w.Title || got.SongID != w.SongID || got.Outcome != w.Outcome ||
+			!got.Start.Equal(w.Start) || !got.End.Equal(w.End) {
+			t.Errorf("verdict %d: got %+v, want %+v", i, got, w)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package listener
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// AudioSource is a stream of mono PCM audio, decoders for the formats a
+// station can stream in implement it so the matching doesn't have to care
+// about the format.
+type AudioSource interface {
+	// SampleRate returns the rate of the samples returned by ReadSamples
+	SampleRate() int
+	// ReadSamples reads up to len(dst) samples between -1 and 1 into dst, it
+	// returns the amount read and the time of the first one since the start
+	// of the source. It returns io.EOF once the source is exhausted.
+	ReadSamples(dst []float64) (n int, at time.Duration, err error)
+	Close() error
+}
+
+// sampleClock keeps the time of a stream of samples whose rate can change
+type sampleClock struct {
+	// base is the time at which rate last changed
+	base    time.Duration
+	samples int64
+	rate    int
+}
+
+// now returns the time of the next sample
+func (c *sampleClock) now() time.Duration {
+	if c.rate == 0 {
+		return c.base
+	}
+	return c.base + time.Duration(c.samples)*time.Second/time.Duration(c.rate)
+}
+
+// advance moves the clock n samples at rate forward and returns the time of
+// the first of them
+func (c *sampleClock) advance(n, rate int) time.Duration {
+	if rate != c.rate {
+		c.base, c.samples, c.rate = c.now(), 0, rate
+	}
+	at := c.now()
+	c.samples += int64(n)
+	return at
+}
+
+// decodeS16LE decodes interleaved signed 16-bit little endian frames from src
+// into dst, downmixing the channels to mono. It returns the amount of frames
+// decoded.
+func decodeS16LE(dst []float64, src []byte, channels int) int {
+	frameSize := 2 * channels
+	n := min(len(dst), len(src)/frameSize)
+	for i := range n {
+		frame := src[i*frameSize:]
+		var sum float64
+		for c := range channels {
+			sum += float64(int16(binary.LittleEndian.Uint16(frame[2*c:])))
+		}
+		dst[i] = sum / float64(channels) / 32768
+	}
+	return n
+}
+
+// encodeS16LE appends samples to dst as signed 16-bit little endian
+func encodeS16LE(dst []byte, samples []float64) []byte {
+	for _, s := range samples {
+		v := int16(math.Round(max(-1, min(s, 32767.0/32768)) * 32768))
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(v))
+	}
+	return dst
+}
+
+// PCMSource reads raw interleaved signed 16-bit little endian PCM, such as
+// the output of a decoder running in another process
+type PCMSource struct {
+	r        io.Reader
+	rate     int
+	channels int
+
+	buf []byte
+	// have is the amount of bytes of a partial frame at the start of buf
+	have  int
+	clock sampleClock
+}
+
+var _ AudioSource = (*PCMSource)(nil)
+
+func NewPCMSource(r io.Reader, rate, channels int) *PCMSource {
+	return &PCMSource{r: r, rate: rate, channels: max(channels, 1)}
+}
+
+func (s *PCMSource) SampleRate() int {
+	return s.rate
+}
+
+func (s *PCMSource) ReadSamples(dst []float64) (int, time.Duration, error) {
+	if len(dst) == 0 {
+		return 0, s.clock.now(), nil
+	}
+
+	frameSize := 2 * s.channels
+	want := len(dst) * frameSize
+	if len(s.buf) < want {
+		s.buf = append(s.buf[:s.have], make([]byte, want-s.have)...)
+	}
+
+	n, err := io.ReadAtLeast(s.r, s.buf[s.have:want], frameSize-s.have)
+	total := s.have + n
+	frames := decodeS16LE(dst, s.buf[:total], s.channels)
+
+	// keep the partial frame at the end for the next read
+	s.have = copy(s.buf, s.buf[frames*frameSize:total])
+
+	at := s.clock.advance(frames, s.rate)
+	if frames > 0 {
+		return frames, at, nil
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return 0, at, err
+}
+
+func (s *PCMSource) Close() error {
+	if c, ok := s.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
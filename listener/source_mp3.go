@@ -0,0 +1,38 @@
+package listener
+
+import (
+	"io"
+
+	"github.com/hajimehoshi/go-mp3"
+)
+
+// MP3Source decodes an MP3 stream in pure Go, the sample rate is that of the
+// first frame
+type MP3Source struct {
+	*PCMSource
+	r io.Reader
+}
+
+var _ AudioSource = (*MP3Source)(nil)
+
+// NewMP3Source returns a source decoding r, it reads from r until it finds
+// the first frame
+func NewMP3Source(r io.Reader) (*MP3Source, error) {
+	decoder, err := mp3.NewDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// the decoder always outputs 16-bit stereo
+	return &MP3Source{
+		PCMSource: NewPCMSource(decoder, decoder.SampleRate(), 2),
+		r:         r,
+	}, nil
+}
+
+func (s *MP3Source) Close() error {
+	if c, ok := s.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+//go:build cgo
+
+package listener
+
+import (
+	"io"
+	"time"
+
+	"github.com/drgolem/go-mpg123/mpg123"
+)
+
+// mpg123SampleRate is the rate MPG123Source has libmpg123 convert to
+const mpg123SampleRate = 44100
+
+// newDefaultSource decodes with libmpg123 when cgo is available
+func newDefaultSource(r io.Reader) (AudioSource, error) {
+	return NewMPG123Source(r)
+}
+
+// MPG123Source decodes an MP3 stream with libmpg123, it needs cgo
+type MPG123Source struct {
+	r       io.Reader
+	decoder *mpg123.Decoder
+
+	in    []byte
+	out   []byte
+	clock sampleClock
+}
+
+var _ AudioSource = (*MPG123Source)(nil)
+
+func NewMPG123Source(r io.Reader) (*MPG123Source, error) {
+	decoder, err := mpg123.NewDecoder("")
+	if err != nil {
+		return nil, err
+	}
+
+	// force output format
+	decoder.FormatNone()
+	decoder.Format(mpg123SampleRate, 1, mpg123.ENC_SIGNED_16)
+
+	// open the decoder to Feed calls
+	if err = decoder.OpenFeed(); err != nil {
+		decoder.Delete()
+		return nil, err
+	}
+
+	return &MPG123Source{
+		r:       r,
+		decoder: decoder,
+		in:      make([]byte, 16*1024),
+	}, nil
+}
+
+func (s *MPG123Source) SampleRate() int {
+	return mpg123SampleRate
+}
+
+func (s *MPG123Source) ReadSamples(dst []float64) (int, time.Duration, error) {
+	if len(s.out) < len(dst)*2 {
+		s.out = make([]byte, len(dst)*2)
+	}
+
+	for {
+		n, _ := s.decoder.Read(s.out[:len(dst)*2])
+		if n > 0 {
+			frames := decodeS16LE(dst, s.out[:n], 1)
+			return frames, s.clock.advance(frames, mpg123SampleRate), nil
+		}
+
+		// the decoder needs more data before it can give us anything, this
+		// is reported as an error so there is no telling it apart from
+		// actual errors, those are usually fixed by more data as well
+		m, err := s.r.Read(s.in)
+		if m > 0 {
+			if ferr := s.decoder.Feed(s.in[:m]); ferr != nil {
+				return 0, s.clock.now(), ferr
+			}
+		}
+		if err != nil {
+			return 0, s.clock.now(), err
+		}
+	}
+}
+
+func (s *MPG123Source) Close() error {
+	s.decoder.Delete()
+	if c, ok := s.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !cgo
+
+package listener
+
+import "io"
+
+// newDefaultSource decodes in pure Go when there is no cgo for libmpg123
+func newDefaultSource(r io.Reader) (AudioSource, error) {
+	return NewMP3Source(r)
+}
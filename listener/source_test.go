@@ -0,0 +1,121 @@
+package listener
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// readAll reads src to the end with reads of the sizes given in turn, it
+// checks the time of every read follows the samples before it
+func readAll(t *testing.T, src AudioSource, sizes ...int) []float64 {
+	t.Helper()
+	var samples []float64
+	for i := 0; ; i++ {
+		dst := make([]float64, sizes[i%len(sizes)])
+		n, at, err := src.ReadSamples(dst)
+		if want := time.Duration(len(samples)) * time.Second / time.Duration(src.SampleRate()); at != want {
+			t.Fatalf("read %d: at %v, want %v", i, at, want)
+		}
+		samples = append(samples, dst[:n]...)
+		if errors.Is(err, io.EOF) {
+			if n != 0 {
+				t.Fatalf("read %d: got %d samples with EOF", i, n)
+			}
+			return samples
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 && len(dst) > 0 {
+			t.Fatalf("read %d: no samples and no error", i)
+		}
+	}
+}
+
+func TestPCMSource(t *testing.T) {
+	// stereo frames whose channels average to i/1250, with half a frame at
+	// the end that is dropped
+	var want []float64
+	var pcm []byte
+	for i := range 1001 {
+		v := float64(i) / 1250
+		want = append(want, v)
+		pcm = encodeS16LE(pcm, []float64{v - 0.125, v + 0.125})
+	}
+	pcm = append(pcm, 1, 2)
+
+	tests := []struct {
+		name  string
+		r     func() io.Reader
+		sizes []int
+	}{
+		{"large reads", func() io.Reader { return bytes.NewReader(pcm) }, []int{4096}},
+		{"odd reads", func() io.Reader { return bytes.NewReader(pcm) }, []int{7, 1, 0, 13}},
+		{"one byte at a time", func() io.Reader { return iotest.OneByteReader(bytes.NewReader(pcm)) }, []int{3, 0, 5}},
+		{"data with EOF", func() io.Reader { return iotest.DataErrReader(bytes.NewReader(pcm)) }, []int{333}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := NewPCMSource(tt.r(), 8000, 2)
+			got := readAll(t, src, tt.sizes...)
+			if len(got) != len(want) {
+				t.Fatalf("got %d samples, want %d", len(got), len(want))
+			}
+			for i := range want {
+				// the channels are rounded to 16 bits before averaging
+				if d := got[i] - want[i]; d > 1.0/32768 || d < -1.0/32768 {
+					t.Fatalf("sample %d is %v, want %v", i, got[i], want[i])
+				}
+			}
+
+			// the source stays at EOF
+			if n, _, err := src.ReadSamples(make([]float64, 10)); n != 0 || !errors.Is(err, io.EOF) {
+				t.Errorf("read after EOF = %d, %v", n, err)
+			}
+		})
+	}
+}
+
+func TestPCMSourceEmptyRead(t *testing.T) {
+	// an empty read returns straight away, without waiting on the reader
+	src := NewPCMSource(iotest.ErrReader(errors.New("read")), 8000, 2)
+	if n, at, err := src.ReadSamples(nil); n != 0 || at != 0 || err != nil {
+		t.Errorf("empty read = %d, %v, %v", n, at, err)
+	}
+}
+
+func TestMP3Source(t *testing.T) {
+	data, err := os.ReadFile("testdata/alice-1.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := NewMP3Source(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := readAll(t, src, 1<<16)
+	// 383 frames of 576 samples
+	if len(want) != 383*576 {
+		t.Errorf("decoded %d samples, want %d", len(want), 383*576)
+	}
+
+	src, err = NewMP3Source(iotest.HalfReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readAll(t, src, 1, 0, 577, 33)
+	if len(got) != len(want) {
+		t.Fatalf("odd reads decoded %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("sample %d is %v with odd reads, want %v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package listener
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/Wessie/fingerprinter/generator"
+)
+
+// DefaultWindow is the length of audio matched at once
+const DefaultWindow = 20 * time.Second
+
+// WindowMatcher finds the songs a window of samples came from, it is
+// implemented by generator.Matcher
+type WindowMatcher interface {
+	Find(samples []float64, duration time.Duration, sampleRate int) ([]generator.Match, time.Duration, error)
+}
+
+// StreamListener listens to an icecast stream and matches what it plays
+// against the songs known to Matcher
+type StreamListener struct {
+	// Endpoint is the url of the stream
+	Endpoint string
+	// Client is used to connect to Endpoint
+	Client *http.Client
+	// NewSource returns the source decoding the stream read from r,
+	// NewStreamListener uses libmpg123 if built with cgo and the pure Go MP3
+	// decoder otherwise
+	NewSource func(r io.Reader) (AudioSource, error)
+	// Matcher is asked for the songs of every window
+	Matcher WindowMatcher
+	// Window is the length of audio matched at once, consecutive windows
+	// overlap by half
+	Window time.Duration
+	// Playback is given every window of audio as it is matched if not nil,
+	// it is called from the matching loop so it has to return quickly
+	Playback func(samples []float64, sampleRate int)
+	// Events is called with every event if not nil, calls never overlap but
+	// they hold up the events after them so it should return quickly
+	Events func(Event)
+}
+
+func NewStreamListener(endpoint string, matcher WindowMatcher) *StreamListener {
+	return &StreamListener{
+		Endpoint:  endpoint,
+		Client:    http.DefaultClient,
+		NewSource: newDefaultSource,
+		Matcher:   matcher,
+		Window:    DefaultWindow,
+	}
+}
+
+// listen starts a listener on the stream endpoint and returns it, a source
+// decoding the stream and the clock relating the two, the source is closed when
+// ctx is canceled. The titles and lost connections are sent on the metadataCh
+// of the listener.
+func (sl *StreamListener) listen(ctx context.Context) (*listener, AudioSource, *streamClock, error) {
+	u, err := url.Parse(sl.Endpoint)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	pr, pw := io.Pipe()
+	context.AfterFunc(ctx, func() {
+		pr.CloseWithError(ctx.Err())
+	})
+
+	clock := newStreamClock()
+	// the listener has to run before the source is made, some decoders
+	// read the start of the stream when they're made
+	ln := listenURL(ctx, sl.Client, u, func(ctx context.Context, data []byte) error {
+		_, err := pw.Write(data)
+		return err
+	}, make(chan metadataChange))
+
+	src, err := sl.NewSource(clock.reader(pr))
+	if err != nil {
+		pr.CloseWithError(err)
+		ln.Close()
+		return nil, nil, nil, err
+	}
+	return ln, clock.source(src), clock, nil
+}
+
+// window is a window of audio being matched
+type window struct {
+	at     time.Duration
+	rate   int
+	result chan windowResult
+}
+
+type windowResult struct {
+	matches   []generator.Match
+	confident bool
+	took      time.Duration
+	err       error
+	time      time.Time
+}
+
+// Run listens to the stream and matches it until ctx is canceled
+func (sl *StreamListener) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var emitMu sync.Mutex
+	emit := func(e Event) {
+		if sl.Events == nil {
+			return
+		}
+		emitMu.Lock()
+		defer emitMu.Unlock()
+		sl.Events(e)
+	}
+
+	ln, src, clock, err := sl.listen(ctx)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	defer src.Close()
+
+	// matching runs in the background, stop and wait for it before returning
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// matching a window takes a while, but when decoding runs ahead of the
+	// audio (after a reconnect for example) windows shouldn't pile up
+	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	// windows are passed on in order, so their results are handled in the
+	// order of the audio no matter which finishes first
+	windows := make(chan window, cap(sem))
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sl.aggregate(ctx, ln.metadataCh, windows, clock, emit)
+	}()
+
+	err = matchLoop(src, sl.Window, func(samples []float64, at time.Duration) {
+		rate := src.SampleRate()
+		if sl.Playback != nil {
+			sl.Playback(samples[len(samples)/2:], rate)
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		w := window{at: at, rate: rate, result: make(chan windowResult, 1)}
+		select {
+		case windows <- w:
+		case <-ctx.Done():
+			<-sem
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			matches, took, err := sl.Matcher.Find(samples, sl.Window, rate)
+			confident := err == nil
+			if noMatch, ok := err.(*generator.NoMatchError); ok {
+				matches, err = noMatch.Candidates, nil
+			}
+			w.result <- windowResult{matches, confident, took, err, time.Now()}
+		}()
+	})
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// segment is the audio between two title changes
+type segment struct {
+	title  string
+	scores map[uint32]*Identification
+}
+
+// aggregate attributes the results of windows to the title that was current
+// in the middle of the window, a title ends once a window is past its end.
+// The titles and lost connections come from changes and are placed on the
+// audio with clock. A lost connection ends the audio of a title, but not the
+// title itself.
+func (sl *StreamListener) aggregate(ctx context.Context, changes <-chan metadataChange, windows <-chan window, clock *streamClock, emit func(Event)) {
+	current := segment{scores: map[uint32]*Identification{}}
+	previousOffsets := map[uint32]time.Duration{}
+	// pending are the changes the windows haven't reached yet
+	var pending []metadataChange
+	// end is the end of the last window matched
+	var end time.Duration
+
+	// identify emits the song that scored highest in the audio of the
+	// current title so far
+	identify := func(header EventHeader) {
+		var best Identification
+		for _, id := range current.scores {
+			if best.Score < id.Score {
+				best = *id
+			}
+		}
+		best.Title = current.title
+		if best.Score > 0 {
+			emit(SongIdentified{header, best})
+			if !titleMatches(best.Title, best.Metadata) {
+				emit(Disagreement{header, best})
+			}
+		}
+	}
+	// the title current when the listener stops never ends, it's identified
+	// from the windows matched until then
+	defer func() {
+		identify(EventHeader{time.Now(), end})
+	}()
+
+	for {
+		var w window
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-changes:
+			pending = append(pending, change)
+			continue
+		case w = <-windows:
+		}
+
+		// keep taking changes while waiting, the listener waits on them
+		var res windowResult
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case change := <-changes:
+				pending = append(pending, change)
+			case res = <-w.result:
+				break wait
+			}
+		}
+
+		middle := w.at + sl.Window/2
+		for len(pending) > 0 {
+			change := pending[0]
+			at, ok := clock.timeAt(change.Offset)
+			if !ok || middle < at {
+				break
+			}
+			pending = pending[1:]
+			header := EventHeader{change.Time, at}
+
+			if change.Err != nil {
+				// the audio after a reconnect doesn't follow on the
+				// audio before it, so it's scored anew
+				identify(header)
+				emit(Disconnected{header, change.Err})
+				current.scores = map[uint32]*Identification{}
+				clear(previousOffsets)
+				continue
+			}
+			if change.Title == current.title {
+				// icecast sends the title again after a reconnect,
+				// that doesn't start a new segment
+				continue
+			}
+
+			identify(header)
+			emit(MetadataChanged{
+				EventHeader:  header,
+				Title:        change.Title,
+				Previous:     current.title,
+				ByteOffset:   change.Offset,
+				SampleOffset: sampleOffset(at, w.rate),
+			})
+			current = segment{title: change.Title, scores: map[uint32]*Identification{}}
+		}
+
+		if res.confident {
+			sl.score(current.scores, previousOffsets, res.matches, w.at)
+		}
+		emit(WindowMatched{
+			EventHeader:  EventHeader{res.time, w.at},
+			Title:        current.title,
+			SampleOffset: sampleOffset(w.at, w.rate),
+			Matches:      res.matches,
+			Confident:    res.confident,
+			Took:         res.took,
+			Err:          res.err,
+		})
+		end = w.at + sl.Window
+
+		// later changes are never before what the decoder read so far
+		if len(pending) > 0 {
+			clock.forget(pending[0].Offset)
+		} else {
+			clock.forget(clock.bytesRead())
+		}
+	}
+}
+
+// sampleOffset returns the amount of samples at rate before at
+func sampleOffset(at time.Duration, rate int) int64 {
+	return int64(at) * int64(rate) / int64(time.Second)
+}
+
+// score adds the confident matches of the window at at to scores
+func (sl *StreamListener) score(scores map[uint32]*Identification, previousOffsets map[uint32]time.Duration, matches []generator.Match, at time.Duration) {
+	for _, match := range matches {
+		// consecutive windows overlap by half, so the offset should
+		// advance by half a window if it's the same song
+		score := match.Score
+		delta := match.Offset - previousOffsets[match.SongID]
+		if delta > sl.Window/2-2*time.Second && delta < sl.Window/2+2*time.Second {
+			score *= 2
+		}
+		previousOffsets[match.SongID] = match.Offset
+
+		id := scores[match.SongID]
+		if id == nil {
+			id = &Identification{
+				SongID:   match.SongID,
+				Metadata: match.Metadata,
+				Start:    at,
+			}
+			scores[match.SongID] = id
+		}
+		id.Score += score
+		id.Confidence = max(id.Confidence, match.Confidence)
+		id.Windows++
+		id.Start = min(id.Start, at)
+		if at >= id.End {
+			id.End, id.Offset = at, match.Offset
+		}
+	}
+}
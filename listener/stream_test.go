@@ -0,0 +1,239 @@
+package listener
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Wessie/fingerprinter/generator"
+	"github.com/Wessie/fingerprinter/listener/icecasttest"
+	"github.com/Wessie/fingerprinter/storage"
+)
+
+// fixture is an MP3 file in testdata and its decoded audio
+type fixture struct {
+	title    string
+	data     []byte
+	samples  []float64
+	rate     int
+	duration time.Duration
+}
+
+func loadFixture(t *testing.T, title, name string) fixture {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := NewMP3Source(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var samples []float64
+	buf := make([]float64, 4096)
+	for {
+		n, _, err := src.ReadSamples(buf)
+		samples = append(samples, buf[:n]...)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rate := src.SampleRate()
+	return fixture{
+		title:    title,
+		data:     data,
+		samples:  samples,
+		rate:     rate,
+		duration: time.Duration(len(samples)) * time.Second / time.Duration(rate),
+	}
+}
+
+// indexFixtures fingerprints the fixtures into a new storage, with their
+// titles as metadata
+func indexFixtures(t *testing.T, fixtures ...fixture) *storage.MemoryStorage {
+	t.Helper()
+	db := storage.NewMemoryStorage()
+	if err := generator.CheckVersion(db, generator.DefaultSpectrogramConfig, generator.BandPeakExtractor{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := generator.StoredHashCodec(db, generator.DefaultHashCodec); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range fixtures {
+		id, err := db.RegisterSong(f.title, f.title)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spectrogram, err := generator.Spectrogram(f.samples, f.rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peaks := generator.ExtractPeaks(spectrogram, generator.DefaultSpectrogramConfig)
+		if err := db.StoreFingerprints(generator.Fingerprint(peaks, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestStreamListenerIdentifiesTracks(t *testing.T) {
+	first := loadFixture(t, "Lewis Carroll - Alice 1", "alice-1.mp3")
+	second := loadFixture(t, "Lewis Carroll - Alice 2", "alice-2.mp3")
+	db := indexFixtures(t, first, second)
+
+	matcher, err := generator.NewMatcher(db, generator.DefaultSpectrogramConfig, generator.BandPeakExtractor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last track only ends the one before it
+	server := icecasttest.NewServer(
+		icecasttest.Track{Title: first.title, Data: first.data},
+		icecasttest.Track{Title: second.title, Data: second.data},
+		icecasttest.Track{Title: first.title, Data: first.data},
+	)
+	defer server.Close()
+	// a small interval puts the titles close to where the tracks start
+	server.MetaInt = 256
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var identified []SongIdentified
+	sl := NewStreamListener(server.URL, matcher)
+	sl.NewSource = func(r io.Reader) (AudioSource, error) {
+		return NewMP3Source(r)
+	}
+	sl.Window = 4 * time.Second
+	sl.Events = func(e Event) {
+		// the title current when the listener stops is identified too
+		if e, ok := e.(SongIdentified); ok && ctx.Err() == nil {
+			identified = append(identified, e)
+			if len(identified) == 2 {
+				cancel()
+			}
+		}
+	}
+	if err := sl.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("run stopped with %v", err)
+	}
+
+	want := []struct {
+		title string
+		at    time.Duration
+	}{
+		{first.title, first.duration},
+		{second.title, first.duration + second.duration},
+	}
+	if len(identified) != len(want) {
+		t.Fatalf("got %d songs identified, want %d", len(identified), len(want))
+	}
+
+	// a title is late by up to MetaInt bytes, and the decoder can be off by
+	// a frame at the start of a track
+	const tolerance = 250 * time.Millisecond
+	for i, w := range want {
+		got := identified[i]
+		if got.Title != w.title || got.Metadata != w.title {
+			t.Errorf("song %d: got %q identified as %q, want %q", i, got.Title, got.Metadata, w.title)
+		}
+		if got.At < w.at-tolerance || got.At > w.at+tolerance {
+			t.Errorf("song %d: identified at %v, want %v", i, got.At, w.at)
+		}
+	}
+}
+
+func TestAggregateWithLaggingDecoder(t *testing.T) {
+	const (
+		rate     = 8000
+		byteRate = 2 * rate
+	)
+	sl := NewStreamListener("", nil)
+	sl.Window = time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newStreamClock()
+	changes := make(chan metadataChange)
+	windows := make(chan window)
+	events := make(chan Event, 100)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sl.aggregate(ctx, changes, windows, clock, func(e Event) { events <- e })
+	}()
+
+	// the titles arrive long before the audio they're of is decoded
+	for _, change := range []metadataChange{
+		{Title: "a", Offset: 0},
+		{Title: "b", Offset: 3 * byteRate / 2},
+		{Title: "c", Offset: 5 * byteRate / 2},
+	} {
+		changes <- change
+	}
+
+	// a window belongs to the title current in its middle, a title starting
+	// right in the middle included
+	want := []string{"a", "a", "b", "b", "c", "c"}
+	var got []string
+	var changed []MetadataChanged
+	for i := range want {
+		at := time.Duration(i) * sl.Window / 2
+		// the decoder read and decoded exactly up to the end of the window
+		clock.mu.Lock()
+		clock.read = int64((at + sl.Window).Seconds() * byteRate)
+		clock.mu.Unlock()
+		clock.record(at + sl.Window)
+
+		w := window{at: at, rate: rate, result: make(chan windowResult, 1)}
+		w.result <- windowResult{}
+		windows <- w
+	wait:
+		for {
+			switch e := (<-events).(type) {
+			case MetadataChanged:
+				changed = append(changed, e)
+			case WindowMatched:
+				if e.At != at {
+					t.Fatalf("window at %v matched at %v", at, e.At)
+				}
+				got = append(got, e.Title)
+				break wait
+			}
+		}
+	}
+	cancel()
+	<-done
+
+	if !slices.Equal(got, want) {
+		t.Errorf("windows attributed to %q, want %q", got, want)
+	}
+	wantChanged := []struct {
+		title string
+		at    time.Duration
+	}{
+		{"a", 0},
+		{"b", 1500 * time.Millisecond},
+		{"c", 2500 * time.Millisecond},
+	}
+	if len(changed) != len(wantChanged) {
+		t.Fatalf("got %d title changes, want %d", len(changed), len(wantChanged))
+	}
+	for i, w := range wantChanged {
+		if c := changed[i]; c.Title != w.title || c.At != w.at || c.SampleOffset != sampleOffset(w.at, rate) {
+			t.Errorf("change %d: got %q at %v (sample %d), want %q at %v", i, c.Title, c.At, c.SampleOffset, w.title, w.at)
+		}
+	}
+}
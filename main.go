@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	radio "github.com/R-a-dio/valkyrie"
@@ -38,56 +46,332 @@ func main() {
 	return*/
 	//go listener.Execute(ctx)
 
-	db, err := storage.NewSQLiteClient("test.db")
+	db, err := openStorage(ctx, os.Getenv("FINGERPRINTER_DB"))
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	defer db.Close()
+	defer func() {
+		// an index is written back when closed, which can fail
+		if err := db.Close(); err != nil {
+			log.Println(err)
+		}
+	}()
 
-	/*err = listener.ListenAndMatch(ctx, generator.NewMatcher(db))
+	/*err = listener.ListenAndMatch(ctx, db)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	return*/
 
-	//MatchFile(ctx, db, os.Args[rand.IntN(len(os.Args[1:]))])
-	MatchFile(ctx, db, os.Args[1:][50])
-	return
+	peaks, err := peakExtractor(os.Getenv("FINGERPRINTER_PEAKS"))
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-	group, ctx := errgroup.WithContext(ctx)
-	group.SetLimit(8)
-	for _, filename := range os.Args[1:] {
-		filename := filename
-		group.Go(func() error {
-			metadata := filepath.Base(filename)
-			key := radio.NewSongHash(metadata)
+	files := os.Args[1:]
+	// reindex fingerprints the files given again even if they didn't change,
+	// and every known song that changed or was done with other parameters
+	var reindex bool
 
-			id, err := db.RegisterSong(key.String(), metadata)
-			if err != nil {
-				return err
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "match":
+			for _, filename := range os.Args[2:] {
+				if err := MatchFile(ctx, db, peaks, filename); err != nil {
+					log.Println(err)
+				}
+			}
+			return
+		case "list":
+			if err := ListSongs(db); err != nil {
+				log.Println(err)
+			}
+			return
+		case "verdicts":
+			if err := ListVerdicts(db); err != nil {
+				log.Println(err)
+			}
+			return
+		case "delete":
+			for _, arg := range os.Args[2:] {
+				if err := DeleteSong(db, arg); err != nil {
+					log.Println(err)
+				}
 			}
-			if id == 0 {
-				return nil
+			return
+		case "index":
+			if len(os.Args) != 3 {
+				log.Println("usage: index <path>")
+				return
 			}
+			if err := WriteIndex(db, os.Args[2]); err != nil {
+				log.Println(err)
+			}
+			return
+		case "reindex":
+			files, reindex = os.Args[2:], true
+		}
+	}
 
-			fmt.Println(id, key, filename)
+	// the files are fingerprinted with the current parameters even if the
+	// songs in db were done with others, the versions recorded in db only
+	// change once no song is left on the old ones
+	codec, err := generator.StoredHashCodec(db, generator.DefaultHashCodec)
+	if errors.Is(err, generator.ErrVersionMismatch) {
+		codec, err = generator.DefaultHashCodec, nil
+	}
+	if err == nil {
+		err = generator.CheckVersion(db, generator.DefaultSpectrogramConfig, peaks)
+	}
+	if err != nil && !errors.Is(err, generator.ErrVersionMismatch) {
+		log.Println(err)
+		return
+	}
 
-			err = FingerprintFile(ctx, db, id, filename)
-			if err != nil {
-				return err
-			}
-			return nil
+	ix := &indexer{
+		db:     db,
+		peaks:  peaks,
+		codec:  codec,
+		params: generator.ParamsVersion(generator.DefaultSpectrogramConfig, peaks, codec),
+	}
+	start := time.Now()
+
+	group, gctx := errgroup.WithContext(ctx)
+	group.SetLimit(8)
+	for _, filename := range files {
+		group.Go(func() error {
+			return ix.IndexFile(gctx, filename, reindex)
 		})
 	}
+	err = group.Wait()
 
-	if err = group.Wait(); err != nil {
+	if err == nil && reindex {
+		// the songs that weren't named are only done again if their file
+		// changed or they were done with other parameters
+		var outdated []storage.Song
+		if outdated, err = ix.Outdated(true); err == nil {
+			group, gctx := errgroup.WithContext(ctx)
+			group.SetLimit(8)
+			for _, song := range outdated {
+				group.Go(func() error {
+					err := ix.IndexSong(gctx, song)
+					if err != nil && gctx.Err() == nil {
+						// the song stays outdated, the others can still be
+						// done
+						log.Println(err)
+						return nil
+					}
+					return err
+				})
+			}
+			err = group.Wait()
+		}
+	}
+	if err != nil {
+		log.Println(err)
+	}
+
+	took := time.Since(start)
+	fmt.Printf("stored %d hashes in %s (%.0f hashes/s)\n",
+		ix.hashes.Load(), took.Round(time.Millisecond), float64(ix.hashes.Load())/took.Seconds())
+
+	outdated, err := ix.Outdated(false)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(outdated) > 0 {
+		fmt.Printf("%d songs were fingerprinted with other parameters, run reindex to do them again\n", len(outdated))
+		return
+	}
+	err = generator.RecordVersion(db, generator.DefaultSpectrogramConfig, peaks)
+	if err == nil {
+		err = generator.RecordHashCodec(db, codec)
+	}
+	if err != nil {
 		log.Println(err)
 	}
 }
 
-func FingerprintFile(ctx context.Context, db storage.Storage, id uint32, filename string) error {
+// indexer fingerprints files into db with the parameters given
+type indexer struct {
+	db     storage.Storage
+	peaks  generator.PeakExtractor
+	codec  generator.HashCodec
+	params string
+
+	// hashes is the amount of fingerprints stored so far
+	hashes atomic.Int64
+}
+
+// IndexFile fingerprints the file given as a song. A known song is only done
+// again if the file changed, if it was done with other parameters or if force
+// is true.
+func (ix *indexer) IndexFile(ctx context.Context, filename string, force bool) error {
+	metadata := filepath.Base(filename)
+	key := radio.NewSongHash(metadata)
+
+	hash, err := ContentHash(filename)
+	if err != nil {
+		return err
+	}
+
+	id, err := ix.db.RegisterSong(key.String(), metadata)
+	if err != nil {
+		return err
+	}
+	if id != 0 {
+		return ix.fingerprint(ctx, id, false, filename, hash)
+	}
+
+	song, ok, err := ix.db.GetSongByKey(key.String())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("song %s disappeared while indexing", key)
+	}
+	if !force && song.ContentHash == hash && song.ParamsVersion == ix.params {
+		return nil
+	}
+	return ix.fingerprint(ctx, song.ID, true, filename, hash)
+}
+
+// IndexSong fingerprints a known song again from the file it was
+// fingerprinted from
+func (ix *indexer) IndexSong(ctx context.Context, song storage.Song) error {
+	if song.FilePath == "" {
+		return fmt.Errorf("song %d %q has no file recorded, index its file or delete it", song.ID, song.Metadata)
+	}
+	hash, err := ContentHash(song.FilePath)
+	if err != nil {
+		return err
+	}
+	return ix.fingerprint(ctx, song.ID, true, song.FilePath, hash)
+}
+
+// fingerprint fingerprints the file given for song id and records its
+// provenance, the fingerprints of a known song are replaced
+func (ix *indexer) fingerprint(ctx context.Context, id uint32, known bool, filename, hash string) error {
+	fmt.Println(id, filename)
+
+	fp, duration, err := FingerprintFile(ctx, ix.peaks, ix.codec, id, filename)
+	if err != nil {
+		return err
+	}
+
+	if known {
+		err = ix.db.ReplaceFingerprints(id, fp)
+	} else {
+		err = ix.db.StoreFingerprints(fp)
+	}
+	if err != nil {
+		return err
+	}
+	ix.hashes.Add(int64(len(fp)))
+
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		path = filename
+	}
+	return ix.db.SetProvenance(id, storage.Provenance{
+		FilePath:      path,
+		Duration:      duration,
+		SampleRate:    44100,
+		ContentHash:   hash,
+		HashCount:     len(fp),
+		ParamsVersion: ix.params,
+	})
+}
+
+// Outdated returns the songs in db that were fingerprinted with other
+// parameters. If files is true it also returns the songs whose file changed
+// since, which means reading all of them.
+func (ix *indexer) Outdated(files bool) ([]storage.Song, error) {
+	const pageSize = 500
+
+	var outdated []storage.Song
+	for after := uint32(0); ; {
+		songs, err := ix.db.ListSongs(after, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(songs) == 0 {
+			return outdated, nil
+		}
+		for _, song := range songs {
+			if song.ParamsVersion != ix.params {
+				outdated = append(outdated, song)
+				continue
+			}
+			if !files {
+				continue
+			}
+			// a file that is gone can't be done again, the song is kept
+			if hash, err := ContentHash(song.FilePath); err == nil && hash != song.ContentHash {
+				outdated = append(outdated, song)
+			}
+		}
+		after = songs[len(songs)-1].ID
+	}
+}
+
+// ContentHash returns the hex encoded SHA-256 of the file given
+func ContentHash(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// closingStorage is a storage that has to be closed when done
+type closingStorage interface {
+	storage.Storage
+	Close() error
+}
+
+// openStorage opens the storage at dsn, a postgres:// URL opens a Postgres
+// database, a .idx file an index and anything else a SQLite file, test.db if
+// dsn is empty. Changes to an index are kept in memory and written back to it
+// when it is closed.
+func openStorage(ctx context.Context, dsn string) (closingStorage, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return storage.NewPostgresClient(ctx, dsn)
+	}
+	if strings.HasSuffix(dsn, ".idx") {
+		return storage.OpenIndexStorage(dsn)
+	}
+	if dsn == "" {
+		dsn = "test.db"
+	}
+	return storage.NewSQLiteClient(dsn)
+}
+
+// peakExtractor returns the peak extractor called name, the band extractor if
+// name is empty
+func peakExtractor(name string) (generator.PeakExtractor, error) {
+	switch name {
+	case "", "band":
+		return generator.BandPeakExtractor{}, nil
+	case "constellation":
+		return generator.DefaultConstellationPeakExtractor, nil
+	}
+	return nil, fmt.Errorf("unknown peak extractor %q, use band or constellation", name)
+}
+
+// FingerprintFile returns the fingerprints of the file given for the song id
+// and the duration of the audio
+func FingerprintFile(ctx context.Context, peaks generator.PeakExtractor, codec generator.HashCodec, id uint32, filename string) ([]storage.Fingerprint, time.Duration, error) {
 	format := audio.Format{
 		Type:     audio.TypeSigned,
 		Size:     audio.Size16Bit,
@@ -97,41 +381,117 @@ func FingerprintFile(ctx context.Context, db storage.Storage, id uint32, filenam
 
 	f, err := audio.DecodeFileAdvanced(ctx, filename, format)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	defer f.Close()
 
 	mapped, err := f.Map()
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	defer f.Unmap()
 
-	dur := time.Duration(len(mapped)) * time.Second / time.Duration(2*44100)
+	// the decoded file is fed through the STFT in chunks, so only the
+	// spectrogram is kept in memory and never the whole file as samples
+	var spectro [][]complex128
+	stft, err := generator.NewSTFT(generator.DefaultSpectrogramConfig, 44100, func(_ int, frame []complex128) error {
+		spectro = append(spectro, frame)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := stft.ReadFrom(bytes.NewReader(mapped)); err != nil {
+		return nil, 0, err
+	}
+	if err := stft.Flush(); err != nil {
+		return nil, 0, err
+	}
 
-	samples := generator.S16LEToF64LE(mapped)
+	duration := time.Duration(len(mapped)/2) * time.Second / 44100
 	// we're done with the file now
 	f.Close()
 	f.Unmap()
 
-	spectro, err := generator.Spectrogram(samples, 44100)
-	if err != nil {
+	found := peaks.ExtractPeaks(spectro, generator.DefaultSpectrogramConfig)
+	return codec.Fingerprint(found, id), duration, nil
+}
+
+// WriteIndex writes the contents of db to an index file at path
+func WriteIndex(db storage.Storage, path string) error {
+	indexer, ok := db.(interface{ WriteIndex(path string) error })
+	if !ok {
+		return fmt.Errorf("%T can't be written to an index", db)
+	}
+
+	start := time.Now()
+	if err := indexer.WriteIndex(path); err != nil {
 		return err
 	}
+	fmt.Println("wrote", path, "in", time.Since(start).Round(time.Millisecond))
+	return nil
+}
 
-	peaks := generator.ExtractPeaks(spectro, dur)
-	fp := generator.Fingerprint(peaks, id)
-	//fingerprints := generator.FingerprintIter(peaks, uint32(id))
+// ListSongs prints every song in db
+func ListSongs(db storage.Storage) error {
+	const pageSize = 500
 
-	err = db.StoreFingerprints(fp)
+	for after := uint32(0); ; {
+		songs, err := db.ListSongs(after, pageSize)
+		if err != nil {
+			return err
+		}
+		if len(songs) == 0 {
+			return nil
+		}
+		for _, song := range songs {
+			fmt.Println(song.ID, song.Key, song.Metadata)
+		}
+		after = songs[len(songs)-1].ID
+	}
+}
+
+// ListVerdicts prints every verdict stored by a listener
+func ListVerdicts(db storage.Storage) error {
+	const pageSize = 500
+
+	for after := uint32(0); ; {
+		verdicts, err := db.ListVerdicts(after, pageSize)
+		if err != nil {
+			return err
+		}
+		if len(verdicts) == 0 {
+			return nil
+		}
+		for _, v := range verdicts {
+			fmt.Printf("%s\t%s\t%s\t%q\t%q\t%.2f\n", v.Start.Format(time.DateTime),
+				v.End.Sub(v.Start).Round(time.Second), v.Outcome, v.Title, v.Metadata, v.Confidence)
+		}
+		after = verdicts[len(verdicts)-1].ID
+	}
+}
+
+// DeleteSong deletes the song with the ID given as a string
+func DeleteSong(db storage.Storage, arg string) error {
+	id, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid song id %q: %w", arg, err)
+	}
+
+	ok, err := db.DeleteSong(uint32(id))
 	if err != nil {
 		return err
 	}
-	_ = fp
+	if !ok {
+		return fmt.Errorf("song %d doesn't exist", id)
+	}
+	fmt.Println("deleted", id)
 	return nil
 }
 
-func MatchFile(ctx context.Context, db storage.Storage, filename string) error {
+// MatchFile matches the file given against the songs in db, peaks has to be
+// the extractor the songs were fingerprinted with
+func MatchFile(ctx context.Context, db storage.Storage, peaks generator.PeakExtractor, filename string) error {
 	format := audio.Format{
 		Type:     audio.TypeSigned,
 		Size:     audio.Size16Bit,
@@ -151,8 +511,6 @@ func MatchFile(ctx context.Context, db storage.Storage, filename string) error {
 	}
 	defer f.Unmap()
 
-	mapped = mapped[30*2*44100:]
-
 	dur := time.Duration(len(mapped)) * time.Second / time.Duration(2*44100)
 
 	samples := generator.S16LEToF64LE(mapped)
@@ -160,7 +518,18 @@ func MatchFile(ctx context.Context, db storage.Storage, filename string) error {
 	f.Close()
 	f.Unmap()
 
-	matches, took, err := generator.NewMatcher(db).Find(samples, dur, 44100)
+	matcher, err := generator.NewMatcher(db, generator.DefaultSpectrogramConfig, peaks)
+	if err != nil {
+		return err
+	}
+
+	matches, took, err := matcher.Find(samples, dur, 44100)
+	if errors.Is(err, generator.ErrNoMatch) {
+		fmt.Println("looking for:", filename)
+		fmt.Println(took)
+		fmt.Println(err)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -168,7 +537,7 @@ func MatchFile(ctx context.Context, db storage.Storage, filename string) error {
 	fmt.Println("looking for:", filename)
 	fmt.Println(took)
 	for _, match := range matches {
-		fmt.Println(match.Score, match.Metadata)
+		fmt.Println(match.Score, match.Confidence, match.Metadata)
 		break
 	}
 
@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+)
+
+// An index file is an immutable inverted index from address to couples, it is
+// laid out as follows, all fixed size numbers are little endian:
+//
+//	header     indexHeaderSize bytes, see indexHeader
+//	couples    for every address a uvarint count followed by its couples
+//	           sorted by song ID and anchor time, each as the uvarint delta
+//	           of the song ID to the previous couple and the uvarint anchor
+//	           time, which is a delta as well if the song ID didn't change
+//	directory  for every address in ascending order the address and the
+//	           offset of its couples, both as uint64
+//	meta       the songs, settings and verdicts as a MemoryStorage snapshot
+const (
+	indexHeaderSize    = 64
+	indexDirectorySize = 16
+	indexVersion       = 1
+)
+
+var indexMagic = [4]byte{'F', 'P', 'I', 'X'}
+
+// ErrIndexFormat is returned when opening a file that isn't a valid index
+var ErrIndexFormat = errors.New("invalid index file")
+
+type indexHeader struct {
+	Magic           [4]byte
+	Version         uint32
+	Addresses       uint64
+	CouplesOffset   uint64
+	CouplesLength   uint64
+	DirectoryOffset uint64
+	MetaOffset      uint64
+	MetaLength      uint64
+}
+
+// Index is an opened index file, it is safe for concurrent use without any
+// locking since it never changes.
+type Index struct {
+	data      []byte
+	unmap     func() error
+	couples   []byte
+	directory []byte
+	meta      []byte
+}
+
+// OpenIndex opens the index file at path, the file is memory mapped where
+// possible
+func OpenIndex(path string) (*Index, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < indexHeaderSize {
+		return nil, fmt.Errorf("%w: file is too small", ErrIndexFormat)
+	}
+
+	data, unmap, err := mapFile(f, int(info.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("error mapping index: %w", err)
+	}
+
+	ix, err := newIndex(data)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	ix.unmap = unmap
+	return ix, nil
+}
+
+// newIndex checks the layout of data and returns an Index for it
+func newIndex(data []byte) (*Index, error) {
+	var h indexHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrIndexFormat, err)
+	}
+	if h.Magic != indexMagic {
+		return nil, fmt.Errorf("%w: bad header", ErrIndexFormat)
+	}
+	if h.Version != indexVersion {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrIndexFormat, h.Version)
+	}
+
+	section := func(offset, length uint64) ([]byte, bool) {
+		if offset > uint64(len(data)) || length > uint64(len(data))-offset {
+			return nil, false
+		}
+		return data[offset : offset+length], true
+	}
+
+	couples, ok1 := section(h.CouplesOffset, h.CouplesLength)
+	directory, ok2 := section(h.DirectoryOffset, h.Addresses*indexDirectorySize)
+	meta, ok3 := section(h.MetaOffset, h.MetaLength)
+	if !ok1 || !ok2 || !ok3 || h.Addresses > uint64(len(data))/indexDirectorySize {
+		return nil, fmt.Errorf("%w: section out of bounds", ErrIndexFormat)
+	}
+
+	ix := &Index{data: data, couples: couples, directory: directory, meta: meta}
+
+	// check the directory once here so lookups don't have to
+	var previous Address
+	var previousOffset uint64
+	for i := range ix.Len() {
+		address, offset := ix.entry(i)
+		if i > 0 && address <= previous || offset < previousOffset || offset > uint64(len(couples)) {
+			return nil, fmt.Errorf("%w: directory entry %d is out of order", ErrIndexFormat, i)
+		}
+		previous, previousOffset = address, offset
+	}
+	return ix, nil
+}
+
+func (ix *Index) Close() error {
+	if ix.unmap == nil {
+		return nil
+	}
+	unmap := ix.unmap
+	ix.unmap = nil
+	return unmap()
+}
+
+// Len returns the amount of addresses in the index
+func (ix *Index) Len() int {
+	return len(ix.directory) / indexDirectorySize
+}
+
+// entry returns the address and couples offset of directory entry i
+func (ix *Index) entry(i int) (Address, uint64) {
+	e := ix.directory[i*indexDirectorySize:]
+	return Address(binary.LittleEndian.Uint64(e)), binary.LittleEndian.Uint64(e[8:])
+}
+
+// Lookup appends the couples of address to dst
+func (ix *Index) Lookup(dst []Couple, address Address) []Couple {
+	n := ix.Len()
+	i := sort.Search(n, func(i int) bool {
+		a, _ := ix.entry(i)
+		return a >= address
+	})
+	if i == n {
+		return dst
+	}
+	if a, _ := ix.entry(i); a != address {
+		return dst
+	}
+	return ix.decode(dst, i)
+}
+
+// decode appends the couples of directory entry i to dst
+func (ix *Index) decode(dst []Couple, i int) []Couple {
+	_, start := ix.entry(i)
+	end := uint64(len(ix.couples))
+	if i+1 < ix.Len() {
+		_, end = ix.entry(i + 1)
+	}
+	buf := ix.couples[start:end]
+
+	next := func() uint64 {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			buf = nil
+			return 0
+		}
+		buf = buf[n:]
+		return v
+	}
+
+	var c Couple
+	for count := next(); count > 0 && len(buf) > 0; count-- {
+		songDelta := next()
+		time := next()
+		if songDelta == 0 {
+			time += uint64(c.AnchorTimeMs)
+		}
+		c = Couple{AnchorTimeMs: uint32(time), SongID: c.SongID + uint32(songDelta)}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// compareCouplesBySong orders couples the way they're stored in an index
+func compareCouplesBySong(a, b Couple) int {
+	return cmp.Or(cmp.Compare(a.SongID, b.SongID), cmp.Compare(a.AnchorTimeMs, b.AnchorTimeMs))
+}
+
+// writeIndex writes an index file to path. The songs, settings and verdicts
+// are taken from meta, the couples from source which has to call its argument
+// for every address in ascending order. The file is written next to path first and
+// renamed once complete.
+func writeIndex(path string, meta *MemoryStorage, source func(func(Address, []Couple) error) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	if _, err := f.Seek(indexHeaderSize, io.SeekStart); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+
+	h := indexHeader{Magic: indexMagic, Version: indexVersion, CouplesOffset: indexHeaderSize}
+
+	var directory []byte
+	var buf []byte
+	var previous Address
+	err = source(func(address Address, couples []Couple) error {
+		if h.Addresses > 0 && address <= previous {
+			return fmt.Errorf("address %#x is not in ascending order", address)
+		}
+		couples = slices.Compact(slices.SortedFunc(slices.Values(couples), compareCouplesBySong))
+
+		directory = binary.LittleEndian.AppendUint64(directory, uint64(address))
+		directory = binary.LittleEndian.AppendUint64(directory, h.CouplesLength)
+
+		buf = binary.AppendUvarint(buf[:0], uint64(len(couples)))
+		var last Couple
+		for _, c := range couples {
+			buf = binary.AppendUvarint(buf, uint64(c.SongID-last.SongID))
+			if c.SongID == last.SongID {
+				buf = binary.AppendUvarint(buf, uint64(c.AnchorTimeMs-last.AnchorTimeMs))
+			} else {
+				buf = binary.AppendUvarint(buf, uint64(c.AnchorTimeMs))
+			}
+			last = c
+		}
+
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		h.CouplesLength += uint64(len(buf))
+		h.Addresses++
+		previous = address
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error writing couples: %w", err)
+	}
+
+	h.DirectoryOffset = h.CouplesOffset + h.CouplesLength
+	if _, err := w.Write(directory); err != nil {
+		return fmt.Errorf("error writing directory: %w", err)
+	}
+
+	h.MetaOffset = h.DirectoryOffset + uint64(len(directory))
+	counter := &countingWriter{w: w}
+	if err := meta.snapshot(counter, false); err != nil {
+		return fmt.Errorf("error writing meta: %w", err)
+	}
+	h.MetaLength = uint64(counter.n)
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := binary.Write(f, binary.LittleEndian, h); err != nil {
+		return fmt.Errorf("error writing header: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteIndex builds an index file at path from the contents of db
+func (db *SQLiteClient) WriteIndex(path string) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	meta := NewMemoryStorage()
+
+	rows, err := db.db.Query("SELECT key, value FROM settings")
+	if err != nil {
+		return fmt.Errorf("error querying settings: %s", err)
+	}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		meta.settings[key] = value
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading rows: %s", err)
+	}
+
+	rows, err = db.db.Query("SELECT " + songColumns + " FROM songs")
+	if err != nil {
+		return fmt.Errorf("error querying songs: %s", err)
+	}
+	for rows.Next() {
+		song, err := scanSong(rows)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		meta.songs[song.ID] = song
+		meta.keys[song.Key] = song.ID
+		meta.lastID = max(meta.lastID, song.ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading rows: %s", err)
+	}
+
+	// AUTOINCREMENT never reuses IDs of deleted songs, neither should the index
+	var seq uint32
+	err = db.db.Get(&seq, "SELECT COALESCE(MAX(seq), 0) FROM sqlite_sequence WHERE name = 'songs'")
+	if err != nil {
+		return fmt.Errorf("error reading song sequence: %s", err)
+	}
+	meta.lastID = max(meta.lastID, seq)
+
+	rows, err = db.db.Query("SELECT " + verdictColumns + " FROM verdicts ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("error querying verdicts: %s", err)
+	}
+	for rows.Next() {
+		v, err := scanVerdict(rows)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		// the memory storage numbers verdicts itself
+		v.ID = uint32(len(meta.verdicts) + 1)
+		meta.verdicts = append(meta.verdicts, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading rows: %s", err)
+	}
+
+	return writeIndex(path, meta, func(fn func(Address, []Couple) error) error {
+		rows, err := db.db.Query("SELECT address, anchorTimeMs, songID FROM fingerprints ORDER BY address")
+		if err != nil {
+			return fmt.Errorf("error querying fingerprints: %s", err)
+		}
+		defer rows.Close()
+
+		var current Address
+		var couples []Couple
+		for rows.Next() {
+			var address Address
+			var c Couple
+			if err := rows.Scan(&address, &c.AnchorTimeMs, &c.SongID); err != nil {
+				return fmt.Errorf("error scanning row: %s", err)
+			}
+			if len(couples) > 0 && address != current {
+				if err := fn(current, couples); err != nil {
+					return err
+				}
+				couples = couples[:0]
+			}
+			current = address
+			couples = append(couples, c)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error reading rows: %s", err)
+		}
+		if len(couples) > 0 {
+			return fn(current, couples)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,269 @@
+package storage_test
+
+import (
+	"cmp"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/Wessie/fingerprinter/storage"
+	"github.com/Wessie/fingerprinter/storage/storagetest"
+)
+
+func TestWriteIndexRoundTrip(t *testing.T) {
+	db := newSQLiteTestClient(t)
+	s := newIndexTestStorage(t)
+	storagetest.Same(t, db, s, 7)
+
+	// an index written by an IndexStorage, and merged with its base
+	// when written again
+	reopened := reopenIndex(t, s)
+	storagetest.Equal(t, db, reopened)
+	storagetest.Equal(t, db, reopenIndex(t, reopened))
+
+	// an index written from SQLite
+	path := filepath.Join(t.TempDir(), "sqlite.fpix")
+	if err := db.WriteIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	fromSQLite, err := storage.OpenIndexStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromSQLite.Close()
+	storagetest.Equal(t, db, fromSQLite)
+
+	// the IDs of deleted songs aren't handed out again
+	if a, b := mustRegisterBoth(t, db, fromSQLite); a != b {
+		t.Errorf("new song got ID %d, want %d", b, a)
+	}
+}
+
+// checkIndexCouples checks that the couples of every address in want are
+// stored in s, and nothing else
+func checkIndexCouples(t *testing.T, s storage.Storage, addresses []storage.Address, want map[storage.Address][]storage.Couple) {
+	t.Helper()
+	got, err := s.GetCouples(addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compare := func(a, b storage.Couple) int {
+		return cmp.Or(cmp.Compare(a.SongID, b.SongID), cmp.Compare(a.AnchorTimeMs, b.AnchorTimeMs))
+	}
+	for _, address := range addresses {
+		g := slices.SortedFunc(slices.Values(got[address]), compare)
+		w := slices.SortedFunc(slices.Values(want[address]), compare)
+		if !slices.Equal(g, w) {
+			t.Errorf("couples of %d are %v, want %v", address, g, w)
+		}
+	}
+}
+
+func TestIndexStorageHidesBaseCouples(t *testing.T) {
+	s := newIndexTestStorage(t)
+	a, err := s.RegisterSong("key-a", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.RegisterSong("key-b", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const orphan = 1000 // fingerprints without a song
+	var addresses []storage.Address
+	var fps []storage.Fingerprint
+	for address := range storage.Address(10) {
+		addresses = append(addresses, address)
+		fps = append(fps,
+			storage.Fingerprint{Address: address, Couple: storage.Couple{AnchorTimeMs: 100, SongID: a}},
+			storage.Fingerprint{Address: address, Couple: storage.Couple{AnchorTimeMs: 200, SongID: b}},
+		)
+	}
+	fps = append(fps, storage.Fingerprint{Address: 0, Couple: storage.Couple{AnchorTimeMs: 300, SongID: orphan}})
+	if err := s.StoreFingerprints(fps); err != nil {
+		t.Fatal(err)
+	}
+
+	// everything is in the base index from here on
+	s = reopenIndex(t, s)
+	addresses = append(addresses, 10)
+
+	if ok, err := s.DeleteSong(a); err != nil || !ok {
+		t.Fatalf("DeleteSong = %v, %v", ok, err)
+	}
+	replacement := []storage.Fingerprint{{Address: 10, Couple: storage.Couple{AnchorTimeMs: 50, SongID: b}}}
+	if err := s.ReplaceFingerprints(b, replacement); err != nil {
+		t.Fatal(err)
+	}
+	want := map[storage.Address][]storage.Couple{
+		0:  {{AnchorTimeMs: 300, SongID: orphan}},
+		10: {{AnchorTimeMs: 50, SongID: b}},
+	}
+	checkIndexCouples(t, s, addresses, want)
+
+	if ok, err := s.DeleteSong(orphan); err != nil || ok {
+		t.Fatalf("DeleteSong of a song that doesn't exist = %v, %v", ok, err)
+	}
+	delete(want, 0)
+	checkIndexCouples(t, s, addresses, want)
+
+	// the base couples stay hidden once merged into a new index
+	s = reopenIndex(t, s)
+	checkIndexCouples(t, s, addresses, want)
+	if _, ok, err := s.GetSongByID(a); err != nil || ok {
+		t.Errorf("deleted song is still there: %v, %v", ok, err)
+	}
+}
+
+func TestOpenIndexRejectsTruncatedFiles(t *testing.T) {
+	s := newIndexTestStorage(t)
+	id, err := s.RegisterSong("key", "song")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fps []storage.Fingerprint
+	for i := range 100 {
+		fps = append(fps, storage.Fingerprint{Address: storage.Address(i * 7), Couple: storage.Couple{AnchorTimeMs: uint32(i), SongID: id}})
+	}
+	if err := s.StoreFingerprints(fps); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.fpix")
+	if err := s.WriteIndex(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 10, 63, 64, 200, len(data) / 2, len(data) - 1} {
+		truncated := filepath.Join(dir, "truncated.fpix")
+		if err := os.WriteFile(truncated, data[:size], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if ix, err := storage.OpenIndex(truncated); !errors.Is(err, storage.ErrIndexFormat) {
+			if err == nil {
+				ix.Close()
+			}
+			t.Errorf("%d of %d bytes: got %v, want ErrIndexFormat", size, len(data), err)
+		}
+	}
+}
+
+func TestIndexStorageLookupsSeeWholeChanges(t *testing.T) {
+	s := reopenIndex(t, newIndexTestStorage(t))
+	id, err := s.RegisterSong("key", "song")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const versions = 200
+	addresses := make([]storage.Address, 100)
+	for i := range addresses {
+		addresses[i] = storage.Address(i)
+	}
+	// version v of the song has every address at anchor time v
+	fingerprints := func(v int) []storage.Fingerprint {
+		fps := make([]storage.Fingerprint, len(addresses))
+		for i, address := range addresses {
+			fps[i] = storage.Fingerprint{Address: address, Couple: storage.Couple{AnchorTimeMs: uint32(v), SongID: id}}
+		}
+		return fps
+	}
+	if err := s.ReplaceFingerprints(id, fingerprints(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for v := 1; v < versions; v++ {
+			if err := s.ReplaceFingerprints(id, fingerprints(v)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// every lookup sees one version of the song, and never an older one
+	// than the lookup before it
+	var last uint32
+	lookup := func() {
+		couples, err := s.GetCouples(addresses)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := couples[0][0].AnchorTimeMs
+		for _, address := range addresses {
+			if c := couples[address]; len(c) != 1 || c[0].AnchorTimeMs != v {
+				t.Fatalf("address %d has %v while address 0 is at version %d", address, c, v)
+			}
+		}
+		if v < last {
+			t.Fatalf("saw version %d after %d", v, last)
+		}
+		last = v
+	}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		lookup()
+	}
+	if last != versions-1 {
+		t.Errorf("ended at version %d, want %d", last, versions-1)
+	}
+}
+
+func TestOpenIndexStorageWritesBackOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.fpix")
+	if err := newIndexTestStorage(t).WriteIndex(path); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := storage.OpenIndexStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.RegisterSong("key", "song")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fps := []storage.Fingerprint{{Address: 1, Couple: storage.Couple{AnchorTimeMs: 10, SongID: id}}}
+	if err := s.StoreFingerprints(fps); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = storage.OpenIndexStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.GetSongByID(id); err != nil || !ok {
+		t.Errorf("song is gone after reopening: %v, %v", ok, err)
+	}
+	checkIndexCouples(t, s, []storage.Address{1}, map[storage.Address][]storage.Couple{1: {fps[0].Couple}})
+
+	// an index without changes is left alone
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || !slices.Equal(data, written) {
+		t.Errorf("index changed without changes: %v", err)
+	}
+}
@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// IndexStorage is a Storage that serves the fingerprints of an immutable
+// Index, with the changes made since kept in memory on top of it. The two can
+// be merged into a new index with WriteIndex.
+//
+// Lookups never take a lock, the couples stored since and the songs hidden in
+// base are published as a view that is replaced as a whole on every change.
+// Changes copy the view, so the changes on top of base should stay small.
+type IndexStorage struct {
+	base *Index
+	// delta holds the songs, settings and verdicts, the fingerprints stored
+	// since base are in view
+	delta *MemoryStorage
+	// path is the file base was opened from if it is written back on Close,
+	// changed is set once anything changed
+	path    string
+	changed atomic.Bool
+
+	// mu is held while publishing a new view or writing an index
+	mu   sync.Mutex
+	view atomic.Pointer[indexView]
+}
+
+var _ Storage = (*IndexStorage)(nil)
+
+// indexView is what lookups of an IndexStorage see, it is never changed once
+// published
+type indexView struct {
+	// couples are the couples stored since base was built, kept sorted like
+	// MemoryStorage keeps them
+	couples map[Address][]Couple
+	// hidden are songs whose couples in base are no longer valid because
+	// they were deleted or replaced
+	hidden map[uint32]bool
+}
+
+// clone returns a copy of v that can be changed before it is published, the
+// couples of an address are still shared and only copied by insert and
+// deleteSong
+func (v *indexView) clone() *indexView {
+	return &indexView{
+		couples: maps.Clone(v.couples),
+		hidden:  maps.Clone(v.hidden),
+	}
+}
+
+// insert adds c to the couples of address
+func (v *indexView) insert(address Address, c Couple) {
+	couples := v.couples[address]
+	i, found := slices.BinarySearchFunc(couples, c, compareCouples)
+	if !found {
+		// clipping makes Insert copy couples, an older view can still be
+		// reading them
+		v.couples[address] = slices.Insert(slices.Clip(couples), i, c)
+	}
+}
+
+// deleteSong removes the couples of the song given
+func (v *indexView) deleteSong(songID uint32) {
+	isSong := func(c Couple) bool { return c.SongID == songID }
+	for address, couples := range v.couples {
+		if !slices.ContainsFunc(couples, isSong) {
+			continue
+		}
+		couples = slices.DeleteFunc(slices.Clone(couples), isSong)
+		if len(couples) == 0 {
+			delete(v.couples, address)
+		} else {
+			v.couples[address] = couples
+		}
+	}
+}
+
+// NewIndexStorage returns a storage on top of base, base can be nil to start
+// without an index
+func NewIndexStorage(base *Index) (*IndexStorage, error) {
+	delta := NewMemoryStorage()
+	if base != nil {
+		// the songs, settings and verdicts are small enough to keep in
+		// the delta, so only the fingerprints are served from base
+		var err error
+		delta, err = LoadMemoryStorage(bytes.NewReader(base.meta))
+		if err != nil {
+			return nil, fmt.Errorf("error reading index meta: %w", err)
+		}
+	}
+
+	s := &IndexStorage{
+		base:  base,
+		delta: delta,
+	}
+	s.view.Store(&indexView{
+		couples: map[Address][]Couple{},
+		hidden:  map[uint32]bool{},
+	})
+	return s, nil
+}
+
+// OpenIndexStorage opens the index file at path and returns a storage on top
+// of it. The changes made are kept in memory, Close merges them into a new
+// index at path if there are any.
+func OpenIndexStorage(path string) (*IndexStorage, error) {
+	base, err := OpenIndex(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewIndexStorage(base)
+	if err != nil {
+		base.Close()
+		return nil, err
+	}
+	s.path = path
+	return s, nil
+}
+
+// Close writes the index back if it was opened with OpenIndexStorage and
+// changed since, and closes the base index
+func (s *IndexStorage) Close() error {
+	var err error
+	if s.path != "" && s.changed.Load() {
+		if err = s.WriteIndex(s.path); err != nil {
+			err = fmt.Errorf("error writing index back: %w", err)
+		}
+	}
+	if s.base != nil {
+		err = errors.Join(err, s.base.Close())
+	}
+	return err
+}
+
+// baseCouples appends the couples of address in base that are still valid in
+// view to dst
+func (s *IndexStorage) baseCouples(view *indexView, dst []Couple, address Address) []Couple {
+	if s.base == nil {
+		return dst
+	}
+	start := len(dst)
+	dst = s.base.Lookup(dst, address)
+	if len(view.hidden) == 0 {
+		return dst
+	}
+	return append(dst[:start], slices.DeleteFunc(dst[start:], func(c Couple) bool {
+		return view.hidden[c.SongID]
+	})...)
+}
+
+func (s *IndexStorage) GetCouples(addresses []Address) (map[Address][]Couple, error) {
+	view := s.view.Load()
+
+	couples := make(map[Address][]Couple, len(addresses))
+	for _, address := range addresses {
+		if _, ok := couples[address]; ok {
+			continue
+		}
+		c := s.baseCouples(view, slices.Clone(view.couples[address]), address)
+		if len(c) > 0 {
+			couples[address] = c
+		}
+	}
+	return couples, nil
+}
+
+func (s *IndexStorage) StoreFingerprints(fingerprints []Fingerprint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.view.Load()
+	view := current.clone()
+
+	var buf []Couple
+	for _, fp := range fingerprints {
+		// fingerprints that are in base already are left out so lookups
+		// don't have to remove duplicates
+		buf = s.baseCouples(current, buf[:0], fp.Address)
+		if !slices.Contains(buf, fp.Couple) {
+			view.insert(fp.Address, fp.Couple)
+		}
+	}
+
+	s.view.Store(view)
+	s.changed.Store(true)
+	return nil
+}
+
+func (s *IndexStorage) ReplaceFingerprints(songID uint32, fingerprints []Fingerprint) error {
+	for _, fp := range fingerprints {
+		if fp.SongID != songID {
+			return fmt.Errorf("%w: song %d instead of %d", ErrWrongSong, fp.SongID, songID)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	view := s.view.Load().clone()
+	view.deleteSong(songID)
+	view.hidden[songID] = true
+	for _, fp := range fingerprints {
+		view.insert(fp.Address, fp.Couple)
+	}
+
+	s.view.Store(view)
+	s.changed.Store(true)
+	return nil
+}
+
+func (s *IndexStorage) DeleteSong(songID uint32) (bool, error) {
+	ok, err := s.delta.DeleteSong(songID)
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// base can have fingerprints without a song as well, those go too
+	view := s.view.Load().clone()
+	view.deleteSong(songID)
+	view.hidden[songID] = true
+
+	s.view.Store(view)
+	s.changed.Store(true)
+	return ok, nil
+}
+
+func (s *IndexStorage) GetSongByID(songID uint32) (Song, bool, error) {
+	return s.delta.GetSongByID(songID)
+}
+
+func (s *IndexStorage) GetSongByKey(key string) (Song, bool, error) {
+	return s.delta.GetSongByKey(key)
+}
+
+func (s *IndexStorage) RegisterSong(key string, metadata string) (uint32, error) {
+	id, err := s.delta.RegisterSong(key, metadata)
+	if id != 0 {
+		s.changed.Store(true)
+	}
+	return id, err
+}
+
+func (s *IndexStorage) SetProvenance(songID uint32, p Provenance) error {
+	s.changed.Store(true)
+	return s.delta.SetProvenance(songID, p)
+}
+
+func (s *IndexStorage) ListSongs(afterID uint32, limit int) ([]Song, error) {
+	return s.delta.ListSongs(afterID, limit)
+}
+
+func (s *IndexStorage) StoreVerdict(v Verdict) (uint32, error) {
+	s.changed.Store(true)
+	return s.delta.StoreVerdict(v)
+}
+
+func (s *IndexStorage) ListVerdicts(afterID uint32, limit int) ([]Verdict, error) {
+	return s.delta.ListVerdicts(afterID, limit)
+}
+
+func (s *IndexStorage) GetSetting(key string) (string, bool, error) {
+	return s.delta.GetSetting(key)
+}
+
+func (s *IndexStorage) SetSetting(key string, value string) error {
+	s.changed.Store(true)
+	return s.delta.SetSetting(key, value)
+}
+
+// WriteIndex merges the base index and everything stored since into a new
+// index file at path, changes to the fingerprints made while it runs wait for
+// it to finish
+func (s *IndexStorage) WriteIndex(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	view := s.view.Load()
+	extra := slices.Sorted(maps.Keys(view.couples))
+
+	return writeIndex(path, s.delta, func(fn func(Address, []Couple) error) error {
+		var couples []Couple
+		emit := func(address Address) error {
+			couples = s.baseCouples(view, append(couples[:0], view.couples[address]...), address)
+			if len(couples) == 0 {
+				return nil
+			}
+			return fn(address, couples)
+		}
+
+		// walk the base directory and the delta addresses side by side
+		i, n := 0, 0
+		if s.base != nil {
+			n = s.base.Len()
+		}
+		for i < n || len(extra) > 0 {
+			var address Address
+			switch {
+			case i == n:
+				address, extra = extra[0], extra[1:]
+			case len(extra) == 0:
+				address, _ = s.base.entry(i)
+				i++
+			default:
+				base, _ := s.base.entry(i)
+				address = min(base, extra[0])
+				if base == address {
+					i++
+				}
+				if extra[0] == address {
+					extra = extra[1:]
+				}
+			}
+			if err := emit(address); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
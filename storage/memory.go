@@ -0,0 +1,535 @@
+package storage
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memoryShardBits is the log2 of the amount of shards the fingerprints of a
+// MemoryStorage are spread over
+const memoryShardBits = 6
+
+type memoryShard struct {
+	mu sync.RWMutex
+	// couples are kept sorted by anchor time and then song ID, the same order
+	// the SQLite primary key returns them in
+	couples map[Address][]Couple
+}
+
+// MemoryStorage is a Storage that keeps everything in memory, the fingerprints
+// are sharded by address so concurrent ingests and lookups rarely contend.
+type MemoryStorage struct {
+	shards [1 << memoryShardBits]memoryShard
+
+	mu       sync.RWMutex
+	songs    map[uint32]Song
+	keys     map[string]uint32
+	lastID   uint32
+	settings map[string]string
+	// verdicts are never removed, so the ID of a verdict is its index plus one
+	verdicts []Verdict
+}
+
+var _ Storage = (*MemoryStorage)(nil)
+
+func NewMemoryStorage() *MemoryStorage {
+	m := &MemoryStorage{
+		songs:    map[uint32]Song{},
+		keys:     map[string]uint32{},
+		settings: map[string]string{},
+	}
+	for i := range m.shards {
+		m.shards[i].couples = map[Address][]Couple{}
+	}
+	return m
+}
+
+// shard returns the shard address belongs to, addresses are mixed first since
+// their low bits are mostly time delta
+func (m *MemoryStorage) shard(address Address) *memoryShard {
+	return &m.shards[uint64(address)*0x9E3779B97F4A7C15>>(64-memoryShardBits)]
+}
+
+func compareCouples(a, b Couple) int {
+	return cmp.Or(cmp.Compare(a.AnchorTimeMs, b.AnchorTimeMs), cmp.Compare(a.SongID, b.SongID))
+}
+
+func (m *MemoryStorage) StoreFingerprints(fingerprints []Fingerprint) error {
+	for _, fp := range fingerprints {
+		s := m.shard(fp.Address)
+		s.mu.Lock()
+		couples := s.couples[fp.Address]
+		i, found := slices.BinarySearchFunc(couples, fp.Couple, compareCouples)
+		if !found {
+			s.couples[fp.Address] = slices.Insert(couples, i, fp.Couple)
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (m *MemoryStorage) GetCouples(addresses []Address) (map[Address][]Couple, error) {
+	couples := make(map[Address][]Couple, len(addresses))
+	for _, address := range addresses {
+		s := m.shard(address)
+		s.mu.RLock()
+		if c, ok := s.couples[address]; ok {
+			couples[address] = slices.Clone(c)
+		}
+		s.mu.RUnlock()
+	}
+	return couples, nil
+}
+
+// lockShards locks every shard for writing, it returns a function that
+// unlocks them again
+func (m *MemoryStorage) lockShards() (unlock func()) {
+	for i := range m.shards {
+		m.shards[i].mu.Lock()
+	}
+	return func() {
+		for i := range m.shards {
+			m.shards[i].mu.Unlock()
+		}
+	}
+}
+
+// deleteCouples removes every couple of the song given, the caller has to
+// hold the locks of all shards
+func (m *MemoryStorage) deleteCouples(songID uint32) {
+	for i := range m.shards {
+		couples := m.shards[i].couples
+		for address, c := range couples {
+			c = slices.DeleteFunc(c, func(c Couple) bool { return c.SongID == songID })
+			if len(c) == 0 {
+				delete(couples, address)
+			} else {
+				couples[address] = c
+			}
+		}
+	}
+}
+
+func (m *MemoryStorage) ReplaceFingerprints(songID uint32, fingerprints []Fingerprint) error {
+	for _, fp := range fingerprints {
+		if fp.SongID != songID {
+			return fmt.Errorf("%w: song %d instead of %d", ErrWrongSong, fp.SongID, songID)
+		}
+	}
+
+	defer m.lockShards()()
+
+	m.deleteCouples(songID)
+	for _, fp := range fingerprints {
+		couples := m.shard(fp.Address).couples
+		i, found := slices.BinarySearchFunc(couples[fp.Address], fp.Couple, compareCouples)
+		if !found {
+			couples[fp.Address] = slices.Insert(couples[fp.Address], i, fp.Couple)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage) GetSongByID(songID uint32) (Song, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	song, ok := m.songs[songID]
+	return song, ok, nil
+}
+
+// RegisterSong adds a song and returns its ID, the ID is 0 if a song with the
+// same key already exists
+func (m *MemoryStorage) RegisterSong(key string, metadata string) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.keys[key]; ok {
+		return 0, nil
+	}
+
+	// IDs are never reused, like the AUTOINCREMENT of SQLiteClient
+	m.lastID++
+	m.songs[m.lastID] = Song{ID: m.lastID, Key: key, Metadata: metadata}
+	m.keys[key] = m.lastID
+	return m.lastID, nil
+}
+
+func (m *MemoryStorage) GetSongByKey(key string) (Song, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, ok := m.keys[key]
+	return m.songs[id], ok, nil
+}
+
+func (m *MemoryStorage) SetProvenance(songID uint32, p Provenance) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if song, ok := m.songs[songID]; ok {
+		song.Provenance = p
+		m.songs[songID] = song
+	}
+	return nil
+}
+
+func (m *MemoryStorage) DeleteSong(songID uint32) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	song, ok := m.songs[songID]
+	if ok {
+		delete(m.songs, songID)
+		delete(m.keys, song.Key)
+	}
+
+	// fingerprints stored without a song are removed as well, like the SQL
+	// backends do
+	defer m.lockShards()()
+	m.deleteCouples(songID)
+	return ok, nil
+}
+
+func (m *MemoryStorage) ListSongs(afterID uint32, limit int) ([]Song, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var songs []Song
+	for _, song := range m.songs {
+		if song.ID > afterID {
+			songs = append(songs, song)
+		}
+	}
+	slices.SortFunc(songs, func(a, b Song) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	// a negative limit means no limit, like it does in SQLite
+	if limit >= 0 && len(songs) > limit {
+		songs = songs[:limit]
+	}
+	return songs, nil
+}
+
+func (m *MemoryStorage) StoreVerdict(v Verdict) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v.ID = uint32(len(m.verdicts) + 1)
+	m.verdicts = append(m.verdicts, v)
+	return v.ID, nil
+}
+
+func (m *MemoryStorage) ListVerdicts(afterID uint32, limit int) ([]Verdict, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	verdicts := m.verdicts[min(int(afterID), len(m.verdicts)):]
+	if limit >= 0 && len(verdicts) > limit {
+		verdicts = verdicts[:limit]
+	}
+	return slices.Clone(verdicts), nil
+}
+
+func (m *MemoryStorage) GetSetting(key string) (string, bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.settings[key]
+	return value, ok, nil
+}
+
+func (m *MemoryStorage) SetSetting(key string, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.settings[key] = value
+	return nil
+}
+
+func (m *MemoryStorage) Close() error {
+	return nil
+}
+
+// addresses returns every address in m in ascending order, the caller has to
+// hold the read locks of all shards
+func (m *MemoryStorage) addresses() []Address {
+	var addresses []Address
+	for i := range m.shards {
+		for address := range m.shards[i].couples {
+			addresses = append(addresses, address)
+		}
+	}
+	slices.Sort(addresses)
+	return addresses
+}
+
+// memorySnapshotMagic starts every snapshot, the last byte is the version of
+// the format. Version 2 added the provenance of songs, version 3 the verdicts.
+var memorySnapshotMagic = [4]byte{'F', 'P', 'M', 3}
+
+// ErrSnapshotFormat is returned when loading something that isn't a snapshot
+// written by MemoryStorage.Snapshot
+var ErrSnapshotFormat = errors.New("invalid memory storage snapshot")
+
+// Snapshot writes the contents of m to w. The format is a header followed by
+// the settings, the last song ID, the songs, the verdicts and finally the
+// addresses in ascending order, every number is written as a uvarint and
+// addresses as the delta to the previous one.
+func (m *MemoryStorage) Snapshot(w io.Writer) error {
+	return m.snapshot(w, true)
+}
+
+// snapshot is Snapshot, but the fingerprints are left out unless withCouples
+// is set
+func (m *MemoryStorage) snapshot(w io.Writer, withCouples bool) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := range m.shards {
+		m.shards[i].mu.RLock()
+		defer m.shards[i].mu.RUnlock()
+	}
+
+	sw := snapshotWriter{w: bufio.NewWriter(w)}
+	sw.w.Write(memorySnapshotMagic[:])
+
+	settings := make([]string, 0, len(m.settings))
+	for key := range m.settings {
+		settings = append(settings, key)
+	}
+	slices.Sort(settings)
+	sw.uvarint(uint64(len(settings)))
+	for _, key := range settings {
+		sw.string(key)
+		sw.string(m.settings[key])
+	}
+
+	ids := make([]uint32, 0, len(m.songs))
+	for id := range m.songs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	sw.uvarint(uint64(m.lastID))
+	sw.uvarint(uint64(len(ids)))
+	for _, id := range ids {
+		song := m.songs[id]
+		sw.uvarint(uint64(id))
+		sw.string(song.Key)
+		sw.string(song.Metadata)
+		sw.string(song.FilePath)
+		sw.uvarint(uint64(song.Duration.Milliseconds()))
+		sw.uvarint(uint64(song.SampleRate))
+		sw.string(song.ContentHash)
+		sw.uvarint(uint64(song.HashCount))
+		sw.string(song.ParamsVersion)
+	}
+
+	sw.uvarint(uint64(len(m.verdicts)))
+	for _, v := range m.verdicts {
+		sw.string(v.Station)
+		sw.string(v.Title)
+		sw.uvarint(uint64(v.SongID))
+		sw.string(v.Metadata)
+		sw.string(string(v.Outcome))
+		sw.uvarint(math.Float64bits(v.Confidence))
+		sw.uvarint(uint64(v.Start.UnixMilli()))
+		sw.uvarint(uint64(v.End.UnixMilli()))
+	}
+
+	var addresses []Address
+	if withCouples {
+		addresses = m.addresses()
+	}
+
+	sw.uvarint(uint64(len(addresses)))
+	var previous Address
+	for _, address := range addresses {
+		couples := m.shard(address).couples[address]
+		sw.uvarint(uint64(address - previous))
+		sw.uvarint(uint64(len(couples)))
+		for _, c := range couples {
+			sw.uvarint(uint64(c.AnchorTimeMs))
+			sw.uvarint(uint64(c.SongID))
+		}
+		previous = address
+	}
+
+	if sw.err != nil {
+		return fmt.Errorf("error writing snapshot: %w", sw.err)
+	}
+	if err := sw.w.Flush(); err != nil {
+		return fmt.Errorf("error writing snapshot: %w", err)
+	}
+	return nil
+}
+
+// SaveFile writes a snapshot of m to the file at path
+func (m *MemoryStorage) SaveFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := m.Snapshot(f); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// LoadMemoryStorage reads a snapshot written by MemoryStorage.Snapshot
+func LoadMemoryStorage(r io.Reader) (*MemoryStorage, error) {
+	sr := snapshotReader{r: bufio.NewReader(r)}
+
+	var magic [4]byte
+	if _, err := io.ReadFull(sr.r, magic[:]); err != nil || [3]byte(magic[:3]) != [3]byte(memorySnapshotMagic[:3]) {
+		return nil, fmt.Errorf("%w: bad header", ErrSnapshotFormat)
+	}
+	version := magic[3]
+	if version < 1 || version > memorySnapshotMagic[3] {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrSnapshotFormat, version)
+	}
+
+	m := NewMemoryStorage()
+
+	for n := sr.uvarint(); n > 0 && sr.err == nil; n-- {
+		key := sr.string()
+		m.settings[key] = sr.string()
+	}
+
+	m.lastID = sr.uint32()
+	for n := sr.uvarint(); n > 0 && sr.err == nil; n-- {
+		song := Song{ID: sr.uint32(), Key: sr.string(), Metadata: sr.string()}
+		if version >= 2 {
+			song.FilePath = sr.string()
+			song.Duration = time.Duration(sr.uvarint()) * time.Millisecond
+			song.SampleRate = int(sr.uint32())
+			song.ContentHash = sr.string()
+			song.HashCount = int(sr.uvarint())
+			song.ParamsVersion = sr.string()
+		}
+		m.songs[song.ID] = song
+		m.keys[song.Key] = song.ID
+	}
+
+	if version >= 3 {
+		for n := sr.uvarint(); n > 0 && sr.err == nil; n-- {
+			v := Verdict{
+				ID:       uint32(len(m.verdicts) + 1),
+				Station:  sr.string(),
+				Title:    sr.string(),
+				SongID:   sr.uint32(),
+				Metadata: sr.string(),
+				Outcome:  Outcome(sr.string()),
+			}
+			v.Confidence = math.Float64frombits(sr.uvarint())
+			v.Start = time.UnixMilli(int64(sr.uvarint()))
+			v.End = time.UnixMilli(int64(sr.uvarint()))
+			m.verdicts = append(m.verdicts, v)
+		}
+	}
+
+	var address Address
+	for n := sr.uvarint(); n > 0 && sr.err == nil; n-- {
+		address += Address(sr.uvarint())
+		count := sr.uvarint()
+		// the count isn't trusted for the allocation, a corrupt one would
+		// otherwise allocate before running into the end of the snapshot
+		couples := make([]Couple, 0, min(count, 1<<16))
+		for ; count > 0 && sr.err == nil; count-- {
+			couples = append(couples, Couple{AnchorTimeMs: sr.uint32(), SongID: sr.uint32()})
+		}
+		m.shard(address).couples[address] = couples
+	}
+
+	if sr.err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSnapshotFormat, sr.err)
+	}
+	return m, nil
+}
+
+// LoadMemoryStorageFile reads a snapshot from the file at path
+func LoadMemoryStorageFile(path string) (*MemoryStorage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return LoadMemoryStorage(f)
+}
+
+// snapshotWriter remembers the first error so the writes don't each need
+// checking
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (sw *snapshotWriter) uvarint(v uint64) {
+	if sw.err != nil {
+		return
+	}
+	_, sw.err = sw.w.Write(binary.AppendUvarint(sw.buf[:0], v))
+}
+
+func (sw *snapshotWriter) string(s string) {
+	sw.uvarint(uint64(len(s)))
+	if sw.err != nil {
+		return
+	}
+	_, sw.err = sw.w.WriteString(s)
+}
+
+// snapshotReader is the reading side of snapshotWriter
+type snapshotReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (sr *snapshotReader) uvarint() uint64 {
+	if sr.err != nil {
+		return 0
+	}
+	var v uint64
+	v, sr.err = binary.ReadUvarint(sr.r)
+	if sr.err == io.EOF {
+		sr.err = io.ErrUnexpectedEOF
+	}
+	return v
+}
+
+func (sr *snapshotReader) uint32() uint32 {
+	v := sr.uvarint()
+	if v > 1<<32-1 && sr.err == nil {
+		sr.err = fmt.Errorf("value %d out of range", v)
+	}
+	return uint32(v)
+}
+
+func (sr *snapshotReader) string() string {
+	n := sr.uvarint()
+	if sr.err != nil {
+		return ""
+	}
+	if n > 1<<24 {
+		sr.err = fmt.Errorf("string of %d bytes is too long", n)
+		return ""
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(sr.r, buf); err != nil {
+		sr.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	return string(buf)
+}
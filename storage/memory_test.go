@@ -0,0 +1,51 @@
+package storage_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Wessie/fingerprinter/storage"
+	"github.com/Wessie/fingerprinter/storage/storagetest"
+)
+
+func TestMemoryMatchesSQLite(t *testing.T) {
+	for seed := range uint64(5) {
+		storagetest.Same(t, newSQLiteTestClient(t), storage.NewMemoryStorage(), seed)
+	}
+}
+
+func TestMemorySnapshot(t *testing.T) {
+	want := newSQLiteTestClient(t)
+	m := storage.NewMemoryStorage()
+	storagetest.Same(t, want, m, 42)
+
+	var buf bytes.Buffer
+	if err := m.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := storage.LoadMemoryStorage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagetest.Equal(t, want, loaded)
+
+	// the loaded storage keeps working like the original, a new song
+	// doesn't reuse the ID of a deleted one
+	if a, b := mustRegisterBoth(t, want, loaded); a != b {
+		t.Errorf("new song got ID %d after loading, want %d", b, a)
+	}
+}
+
+// mustRegisterBoth registers the same new song in a and b
+func mustRegisterBoth(t *testing.T, a, b storage.Storage) (uint32, uint32) {
+	t.Helper()
+	idA, err := a.RegisterSong("new key", "new song")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idB, err := b.RegisterSong("new key", "new song")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idA, idB
+}
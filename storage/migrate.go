@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// migration is a single change to the schema, it runs in a transaction
+// together with recording its version
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sqlx.Tx) error
+}
+
+// migrations are run in order, a migration should never be changed once it is
+// released, add a new one instead
+var migrations = []migration{
+	{1, "baseline", migrateBaseline},
+	{2, "song provenance", migrateProvenance},
+	{3, "verdicts", migrateVerdicts},
+	{4, "fingerprints song index", migrateSongIndex},
+	{5, "fingerprints without rowid", migrateWithoutRowid},
+}
+
+// ErrSchemaTooNew is returned when opening a database that was migrated by a
+// newer version of this program
+var ErrSchemaTooNew = errors.New("database schema is newer than supported")
+
+// SchemaVersion returns the schema version this program migrates databases to
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrate brings the schema of db up to date
+func migrate(db *sqlx.DB) error {
+	return migrateTo(db, SchemaVersion())
+}
+
+// migrateTo runs the migrations up to and including version
+func migrateTo(db *sqlx.DB, version int) error {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS schema_version (
+        version INTEGER PRIMARY KEY,
+        name TEXT NOT NULL,
+        appliedAt INTEGER NOT NULL
+    );
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating schema_version table: %s", err)
+	}
+
+	for _, m := range migrations {
+		if m.version > version {
+			break
+		}
+		if err := runMigration(db, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runMigration runs m if it hasn't been yet, the current version is checked in
+// the same transaction so two processes opening the same database don't both
+// run it. The transaction has to take the write lock when it begins, which
+// withPragmas sets up, or both could read the version before either writes.
+func runMigration(db *sqlx.DB, m migration) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	var current int
+	if err := tx.Get(&current, "SELECT COALESCE(MAX(version), 0) FROM schema_version"); err != nil {
+		return fmt.Errorf("error reading schema version: %w", err)
+	}
+	if current > SchemaVersion() {
+		return fmt.Errorf("%w: version %d, this program knows up to %d", ErrSchemaTooNew, current, SchemaVersion())
+	}
+	if current >= m.version {
+		return nil
+	}
+
+	if err := m.up(tx); err != nil {
+		return fmt.Errorf("error running migration %d (%s): %w", m.version, m.name, err)
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_version (version, name, appliedAt) VALUES (?, ?, ?)",
+		m.version, m.name, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("error recording migration %d: %w", m.version, err)
+	}
+
+	return tx.Commit()
+}
+
+// migrateBaseline creates the tables as they were before migrations existed,
+// databases from that time already have them
+func migrateBaseline(tx *sqlx.Tx) error {
+	createSongsTable := `
+    CREATE TABLE IF NOT EXISTS songs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		song TEXT NOT NULL,
+		key TEXT NOT NULL UNIQUE
+    );
+    `
+
+	createFingerprintsTable := `
+    CREATE TABLE IF NOT EXISTS fingerprints (
+        address INTEGER NOT NULL,
+        anchorTimeMs INTEGER NOT NULL,
+        songID INTEGER NOT NULL,
+        PRIMARY KEY (address, anchorTimeMs, songID)
+    );
+    `
+
+	createSettingsTable := `
+    CREATE TABLE IF NOT EXISTS settings (
+        key TEXT PRIMARY KEY,
+        value TEXT NOT NULL
+    );
+    `
+
+	_, err := tx.Exec(createSongsTable)
+	if err != nil {
+		return fmt.Errorf("error creating songs table: %s", err)
+	}
+
+	_, err = tx.Exec(createFingerprintsTable)
+	if err != nil {
+		return fmt.Errorf("error creating fingerprints table: %s", err)
+	}
+
+	_, err = tx.Exec(createSettingsTable)
+	if err != nil {
+		return fmt.Errorf("error creating settings table: %s", err)
+	}
+
+	return nil
+}
+
+// migrateProvenance adds the columns that hold the Provenance of a song,
+// columns that exist already are skipped since they used to be added without
+// a migration
+func migrateProvenance(tx *sqlx.Tx) error {
+	columns := []struct{ name, definition string }{
+		{"filePath", "TEXT NOT NULL DEFAULT ''"},
+		{"durationMs", "INTEGER NOT NULL DEFAULT 0"},
+		{"sampleRate", "INTEGER NOT NULL DEFAULT 0"},
+		{"contentHash", "TEXT NOT NULL DEFAULT ''"},
+		{"hashCount", "INTEGER NOT NULL DEFAULT 0"},
+		{"paramsVersion", "TEXT NOT NULL DEFAULT ''"},
+	}
+
+	var existing []string
+	if err := tx.Select(&existing, "SELECT name FROM pragma_table_info('songs')"); err != nil {
+		return fmt.Errorf("error reading columns: %w", err)
+	}
+
+	for _, column := range columns {
+		if slices.Contains(existing, column.name) {
+			continue
+		}
+		_, err := tx.Exec(fmt.Sprintf("ALTER TABLE songs ADD COLUMN %s %s", column.name, column.definition))
+		if err != nil {
+			return fmt.Errorf("error adding column %s: %w", column.name, err)
+		}
+	}
+	return nil
+}
+
+// migrateVerdicts adds the table verdicts are stored in, the times are unix
+// milliseconds
+func migrateVerdicts(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`
+    CREATE TABLE verdicts (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        station TEXT NOT NULL,
+        title TEXT NOT NULL,
+        songID INTEGER NOT NULL,
+        metadata TEXT NOT NULL,
+        outcome TEXT NOT NULL,
+        confidence REAL NOT NULL,
+        startedAt INTEGER NOT NULL,
+        endedAt INTEGER NOT NULL
+    );
+    `)
+	if err != nil {
+		return fmt.Errorf("error creating verdicts table: %s", err)
+	}
+	return nil
+}
+
+// migrateSongIndex indexes the fingerprints by song, deleting or replacing the
+// fingerprints of a song scanned the whole table without it
+func migrateSongIndex(tx *sqlx.Tx) error {
+	_, err := tx.Exec("CREATE INDEX fingerprints_song_id ON fingerprints (songID)")
+	if err != nil {
+		return fmt.Errorf("error creating index: %s", err)
+	}
+	return nil
+}
+
+// migrateWithoutRowid rebuilds the fingerprints table WITHOUT ROWID, the
+// primary key is then the table itself and the couples of an address are
+// stored next to each other
+func migrateWithoutRowid(tx *sqlx.Tx) error {
+	statements := []string{`
+    CREATE TABLE fingerprints_new (
+        address INTEGER NOT NULL,
+        anchorTimeMs INTEGER NOT NULL,
+        songID INTEGER NOT NULL,
+        PRIMARY KEY (address, anchorTimeMs, songID)
+    ) WITHOUT ROWID;
+    `,
+		"INSERT INTO fingerprints_new (address, anchorTimeMs, songID) SELECT address, anchorTimeMs, songID FROM fingerprints",
+		// dropping the old table drops its index as well
+		"DROP TABLE fingerprints",
+		"ALTER TABLE fingerprints_new RENAME TO fingerprints",
+		"CREATE INDEX fingerprints_song_id ON fingerprints (songID)",
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("error rebuilding fingerprints table: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// preMigrationSchema is what databases looked like before migrations existed
+const preMigrationSchema = `
+    CREATE TABLE IF NOT EXISTS songs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		song TEXT NOT NULL,
+		key TEXT NOT NULL UNIQUE
+    );
+
+    CREATE TABLE IF NOT EXISTS fingerprints (
+        address INTEGER NOT NULL,
+        anchorTimeMs INTEGER NOT NULL,
+        songID INTEGER NOT NULL,
+        PRIMARY KEY (address, anchorTimeMs, songID)
+    );
+    `
+
+// openRaw opens the database at path without migrating it
+func openRaw(t *testing.T, path string) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("sqlite", withPragmas(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// schema returns the tables and indexes of db, the SQL they were created with
+// is normalized so it doesn't matter how it was formatted
+func schema(t *testing.T, db *sqlx.DB) string {
+	t.Helper()
+	var rows []struct {
+		Type, Name string
+		SQL        *string
+	}
+	err := db.Select(&rows, "SELECT type, name, sql FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out []string
+	for _, row := range rows {
+		var sql string
+		if row.SQL != nil {
+			sql = strings.Join(strings.Fields(strings.Replace(*row.SQL, "IF NOT EXISTS ", "", 1)), " ")
+		}
+		out = append(out, row.Type+" "+row.Name+": "+sql)
+	}
+	return strings.Join(out, "\n")
+}
+
+func TestMigrateFromFixtures(t *testing.T) {
+	fresh, err := NewSQLiteClient(filepath.Join(t.TempDir(), "fresh.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	want := schema(t, fresh.db)
+
+	// version 0 is a database from before migrations
+	for version := range SchemaVersion() {
+		path := filepath.Join(t.TempDir(), "fixture.sqlite3")
+		raw := openRaw(t, path)
+		if version == 0 {
+			if _, err := raw.Exec(preMigrationSchema); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := migrateTo(raw, version); err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+
+		_, err := raw.Exec("INSERT INTO songs (song, key) VALUES ('song', 'key')")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = raw.Exec("INSERT INTO fingerprints (address, anchorTimeMs, songID) VALUES (1, 100, 1), (1, 200, 1), (2, 300, 1)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw.Close()
+
+		db, err := NewSQLiteClient(path)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		defer db.Close()
+
+		if got := schema(t, db.db); got != want {
+			t.Errorf("version %d: upgraded schema is\n%s\nwant\n%s", version, got, want)
+		}
+
+		var current int
+		if err := db.db.Get(&current, "SELECT MAX(version) FROM schema_version"); err != nil || current != SchemaVersion() {
+			t.Errorf("version %d: upgraded to %d, %v", version, current, err)
+		}
+
+		song, ok, err := db.GetSongByID(1)
+		if err != nil || !ok || song.Key != "key" {
+			t.Errorf("version %d: song after upgrade is %+v, %v, %v", version, song, ok, err)
+		}
+		couples, err := db.GetCouples([]Address{1, 2})
+		if err != nil || len(couples[1]) != 2 || len(couples[2]) != 1 {
+			t.Errorf("version %d: couples after upgrade are %v, %v", version, couples, err)
+		}
+	}
+}
+
+func TestMigrateConcurrently(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.sqlite3")
+
+	// every process opening a new database races to migrate it
+	var wg sync.WaitGroup
+	for range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, err := NewSQLiteClient(path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			db.Close()
+		}()
+	}
+	wg.Wait()
+
+	var versions []int
+	if err := openRaw(t, path).Select(&versions, "SELECT version FROM schema_version ORDER BY version"); err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != SchemaVersion() {
+		t.Errorf("recorded versions %v, want every migration once", versions)
+	}
+}
+func TestSongIndexIsUsed(t *testing.T) {
+	db, err := NewSQLiteClient(filepath.Join(t.TempDir(), "test.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, query := range []string{
+		"DELETE FROM fingerprints WHERE songID = ?",
+		"SELECT address FROM fingerprints WHERE songID = ?",
+	} {
+		var plan []struct {
+			ID, Parent, NotUsed int
+			Detail              string
+		}
+		if err := db.db.Select(&plan, "EXPLAIN QUERY PLAN "+query, 1); err != nil {
+			t.Fatal(err)
+		}
+		if len(plan) == 0 || !strings.Contains(plan[0].Detail, "fingerprints_song_id") {
+			t.Errorf("%s: plan is %+v, want it to use fingerprints_song_id", query, plan)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresClient is a Storage backed by PostgreSQL, unlike SQLiteClient any
+// amount of processes can share the same database.
+//
+// It is tested with the storagetest suite when FINGERPRINTER_POSTGRES_DSN is set
+// to the connection string of a server, every test gets its own schema.
+type PostgresClient struct {
+	pool *pgxpool.Pool
+}
+
+var _ Storage = (*PostgresClient)(nil)
+
+func NewPostgresClient(ctx context.Context, connString string) (*PostgresClient, error) {
+	pool, err := pgxpool.New(ctx, connString)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to Postgres: %s", err)
+	}
+
+	err = migratePostgres(ctx, pool)
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("error migrating database: %w", err)
+	}
+
+	return &PostgresClient{pool: pool}, nil
+}
+
+func (db *PostgresClient) Close() error {
+	db.pool.Close()
+	return nil
+}
+
+// postgresMigrations are run in order like migrations, the versions are
+// separate from those of SQLite
+var postgresMigrations = []struct {
+	version int
+	name    string
+	sql     string
+}{
+	{1, "baseline", `
+    CREATE TABLE songs (
+        id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+        song TEXT NOT NULL,
+        key TEXT NOT NULL UNIQUE,
+        file_path TEXT NOT NULL DEFAULT '',
+        duration_ms BIGINT NOT NULL DEFAULT 0,
+        sample_rate INTEGER NOT NULL DEFAULT 0,
+        content_hash TEXT NOT NULL DEFAULT '',
+        hash_count BIGINT NOT NULL DEFAULT 0,
+        params_version TEXT NOT NULL DEFAULT ''
+    );
+
+    CREATE TABLE fingerprints (
+        address BIGINT NOT NULL,
+        anchor_time_ms BIGINT NOT NULL,
+        song_id INTEGER NOT NULL,
+        PRIMARY KEY (address, anchor_time_ms, song_id)
+    );
+
+    -- deletes and replacements by song would scan the table without it
+    CREATE INDEX fingerprints_song_id ON fingerprints (song_id);
+
+    CREATE TABLE settings (
+        key TEXT PRIMARY KEY,
+        value TEXT NOT NULL
+    );
+    `},
+	{2, "verdicts", `
+    CREATE TABLE verdicts (
+        id INTEGER GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+        station TEXT NOT NULL,
+        title TEXT NOT NULL,
+        song_id INTEGER NOT NULL,
+        metadata TEXT NOT NULL,
+        outcome TEXT NOT NULL,
+        confidence DOUBLE PRECISION NOT NULL,
+        started_at TIMESTAMPTZ NOT NULL,
+        ended_at TIMESTAMPTZ NOT NULL
+    );
+    `},
+}
+
+// postgresMigrationLock is the advisory lock held while migrating, so that
+// instances starting at the same time migrate one after the other
+const postgresMigrationLock = 0x66707269 // "fpri"
+
+// migratePostgres brings the schema of the database up to date
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool) error {
+	latest := postgresMigrations[len(postgresMigrations)-1].version
+
+	return pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", postgresMigrationLock); err != nil {
+			return fmt.Errorf("error taking migration lock: %w", err)
+		}
+
+		_, err := tx.Exec(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_version (
+            version INTEGER PRIMARY KEY,
+            name TEXT NOT NULL,
+            applied_at TIMESTAMPTZ NOT NULL
+        )`)
+		if err != nil {
+			return fmt.Errorf("error creating schema_version table: %s", err)
+		}
+
+		var current int
+		err = tx.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current)
+		if err != nil {
+			return fmt.Errorf("error reading schema version: %w", err)
+		}
+		if current > latest {
+			return fmt.Errorf("%w: version %d, this program knows up to %d", ErrSchemaTooNew, current, latest)
+		}
+
+		for _, m := range postgresMigrations {
+			if m.version <= current {
+				continue
+			}
+			if _, err := tx.Exec(ctx, m.sql); err != nil {
+				return fmt.Errorf("error running migration %d (%s): %w", m.version, m.name, err)
+			}
+			_, err = tx.Exec(ctx, "INSERT INTO schema_version (version, name, applied_at) VALUES ($1, $2, $3)",
+				m.version, m.name, time.Now())
+			if err != nil {
+				return fmt.Errorf("error recording migration %d: %w", m.version, err)
+			}
+		}
+		return nil
+	})
+}
+
+func (db *PostgresClient) StoreFingerprints(fingerprints []Fingerprint) error {
+	if len(fingerprints) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	return pgx.BeginFunc(ctx, db.pool, func(tx pgx.Tx) error {
+		return copyFingerprints(ctx, tx, fingerprints)
+	})
+}
+
+func (db *PostgresClient) ReplaceFingerprints(songID uint32, fingerprints []Fingerprint) error {
+	for _, fp := range fingerprints {
+		if fp.SongID != songID {
+			return fmt.Errorf("%w: song %d instead of %d", ErrWrongSong, fp.SongID, songID)
+		}
+	}
+
+	ctx := context.Background()
+	return pgx.BeginFunc(ctx, db.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "DELETE FROM fingerprints WHERE song_id = $1", songID); err != nil {
+			return fmt.Errorf("error deleting fingerprints: %w", err)
+		}
+		if len(fingerprints) == 0 {
+			return nil
+		}
+		return copyFingerprints(ctx, tx, fingerprints)
+	})
+}
+
+// copyFingerprints inserts the fingerprints given with COPY, COPY can't skip
+// rows that exist already so they go through a temporary table first
+func copyFingerprints(ctx context.Context, tx pgx.Tx, fingerprints []Fingerprint) error {
+	_, err := tx.Exec(ctx, `CREATE TEMPORARY TABLE fingerprints_load
+        (LIKE fingerprints INCLUDING DEFAULTS) ON COMMIT DROP`)
+	if err != nil {
+		return fmt.Errorf("error creating load table: %w", err)
+	}
+
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"fingerprints_load"},
+		[]string{"address", "anchor_time_ms", "song_id"},
+		pgx.CopyFromSlice(len(fingerprints), func(i int) ([]any, error) {
+			fp := fingerprints[i]
+			return []any{int64(fp.Address), int64(fp.AnchorTimeMs), int32(fp.SongID)}, nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("error copying fingerprints: %w", err)
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO fingerprints SELECT * FROM fingerprints_load
+        ON CONFLICT DO NOTHING`)
+	if err != nil {
+		return fmt.Errorf("error inserting fingerprints: %w", err)
+	}
+	return nil
+}
+
+func (db *PostgresClient) GetCouples(addresses []Address) (map[Address][]Couple, error) {
+	couples := make(map[Address][]Couple, len(addresses))
+	if len(addresses) == 0 {
+		return couples, nil
+	}
+
+	args := make([]int64, len(addresses))
+	for i, address := range addresses {
+		args[i] = int64(address)
+	}
+
+	rows, err := db.pool.Query(context.Background(),
+		"SELECT address, anchor_time_ms, song_id FROM fingerprints WHERE address = ANY($1)", args)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address, anchorTimeMs int64
+		var songID int32
+		if err := rows.Scan(&address, &anchorTimeMs, &songID); err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		couples[Address(address)] = append(couples[Address(address)], Couple{
+			AnchorTimeMs: uint32(anchorTimeMs),
+			SongID:       uint32(songID),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %s", err)
+	}
+	return couples, nil
+}
+
+func (db *PostgresClient) RegisterSong(key string, metadata string) (uint32, error) {
+	var id int32
+	err := db.pool.QueryRow(context.Background(),
+		"INSERT INTO songs (song, key) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING RETURNING id",
+		metadata, key).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// the key exists already
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error executing statement: %w", err)
+	}
+	return uint32(id), nil
+}
+
+func (db *PostgresClient) SetProvenance(songID uint32, p Provenance) error {
+	_, err := db.pool.Exec(context.Background(), `UPDATE songs SET file_path = $1, duration_ms = $2,
+        sample_rate = $3, content_hash = $4, hash_count = $5, params_version = $6 WHERE id = $7`,
+		p.FilePath, p.Duration.Milliseconds(), p.SampleRate,
+		p.ContentHash, p.HashCount, p.ParamsVersion, int32(songID))
+	if err != nil {
+		return fmt.Errorf("error executing statement: %w", err)
+	}
+	return nil
+}
+
+// postgresSongColumns are the columns scanPostgresSong expects, in order
+const postgresSongColumns = "id, song, key, file_path, duration_ms, sample_rate, content_hash, hash_count, params_version"
+
+// scanPostgresSong scans a row selected with postgresSongColumns
+func scanPostgresSong(row pgx.Row) (Song, error) {
+	var song Song
+	var id, sampleRate int32
+	var durationMs, hashCount int64
+	err := row.Scan(&id, &song.Metadata, &song.Key, &song.FilePath, &durationMs,
+		&sampleRate, &song.ContentHash, &hashCount, &song.ParamsVersion)
+	song.ID = uint32(id)
+	song.Duration = time.Duration(durationMs) * time.Millisecond
+	song.SampleRate = int(sampleRate)
+	song.HashCount = int(hashCount)
+	return song, err
+}
+
+// getSong returns the single song selected by the WHERE clause given
+func (db *PostgresClient) getSong(where string, arg any) (Song, bool, error) {
+	row := db.pool.QueryRow(context.Background(), "SELECT "+postgresSongColumns+" FROM songs WHERE "+where, arg)
+
+	song, err := scanPostgresSong(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Song{}, false, nil
+		}
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %s", err)
+	}
+	return song, true, nil
+}
+
+func (db *PostgresClient) GetSongByID(songID uint32) (Song, bool, error) {
+	// IDs are stored as INTEGER, anything larger can't exist
+	if songID > 1<<31-1 {
+		return Song{}, false, nil
+	}
+	return db.getSong("id = $1", int32(songID))
+}
+
+func (db *PostgresClient) GetSongByKey(key string) (Song, bool, error) {
+	return db.getSong("key = $1", key)
+}
+
+func (db *PostgresClient) DeleteSong(songID uint32) (bool, error) {
+	if songID > 1<<31-1 {
+		return false, nil
+	}
+
+	ctx := context.Background()
+	var deleted bool
+	err := pgx.BeginFunc(ctx, db.pool, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "DELETE FROM songs WHERE id = $1", int32(songID))
+		if err != nil {
+			return fmt.Errorf("error deleting song: %w", err)
+		}
+		deleted = tag.RowsAffected() > 0
+
+		if _, err := tx.Exec(ctx, "DELETE FROM fingerprints WHERE song_id = $1", int32(songID)); err != nil {
+			return fmt.Errorf("error deleting fingerprints: %w", err)
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+func (db *PostgresClient) ListSongs(afterID uint32, limit int) ([]Song, error) {
+	// a negative limit means no limit, like it does in SQLite
+	var limitArg any
+	if limit >= 0 {
+		limitArg = limit
+	}
+
+	rows, err := db.pool.Query(context.Background(),
+		"SELECT "+postgresSongColumns+" FROM songs WHERE id > $1 ORDER BY id LIMIT $2",
+		int64(afterID), limitArg)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %s", err)
+	}
+	defer rows.Close()
+
+	var songs []Song
+	for rows.Next() {
+		song, err := scanPostgresSong(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		songs = append(songs, song)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %s", err)
+	}
+	return songs, nil
+}
+
+func (db *PostgresClient) StoreVerdict(v Verdict) (uint32, error) {
+	var id int32
+	err := db.pool.QueryRow(context.Background(), `INSERT INTO verdicts (station, title, song_id,
+        metadata, outcome, confidence, started_at, ended_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		v.Station, v.Title, int32(v.SongID), v.Metadata, string(v.Outcome),
+		v.Confidence, v.Start, v.End).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("error executing statement: %w", err)
+	}
+	return uint32(id), nil
+}
+
+func (db *PostgresClient) ListVerdicts(afterID uint32, limit int) ([]Verdict, error) {
+	// a negative limit means no limit, like it does in SQLite
+	var limitArg any
+	if limit >= 0 {
+		limitArg = limit
+	}
+
+	rows, err := db.pool.Query(context.Background(), `SELECT id, station, title, song_id, metadata,
+        outcome, confidence, started_at, ended_at FROM verdicts WHERE id > $1 ORDER BY id LIMIT $2`,
+		int64(afterID), limitArg)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %s", err)
+	}
+	defer rows.Close()
+
+	var verdicts []Verdict
+	for rows.Next() {
+		var v Verdict
+		var id, songID int32
+		var outcome string
+		err := rows.Scan(&id, &v.Station, &v.Title, &songID, &v.Metadata,
+			&outcome, &v.Confidence, &v.Start, &v.End)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		v.ID, v.SongID, v.Outcome = uint32(id), uint32(songID), Outcome(outcome)
+		verdicts = append(verdicts, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %s", err)
+	}
+	return verdicts, nil
+}
+
+func (db *PostgresClient) GetSetting(key string) (string, bool, error) {
+	var value string
+	err := db.pool.QueryRow(context.Background(), "SELECT value FROM settings WHERE key = $1", key).Scan(&value)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to retrieve setting: %s", err)
+	}
+	return value, true, nil
+}
+
+func (db *PostgresClient) SetSetting(key string, value string) error {
+	_, err := db.pool.Exec(context.Background(),
+		"INSERT INTO settings (key, value) VALUES ($1, $2) ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value",
+		key, value)
+	if err != nil {
+		return fmt.Errorf("error executing statement: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/Wessie/fingerprinter/storage"
+	"github.com/Wessie/fingerprinter/storage/storagetest"
+)
+
+// postgresDSNEnv names the environment variable with the connection string of
+// the server the Postgres tests run against, they are skipped without it
+// unless CI is set
+const postgresDSNEnv = "FINGERPRINTER_POSTGRES_DSN"
+
+var postgresSchemas atomic.Int64
+
+// newPostgresTestClient returns a PostgresClient on a new and empty schema,
+// the schema is dropped when the test is done
+func newPostgresTestClient(t *testing.T, dsn string) *storage.PostgresClient {
+	t.Helper()
+	ctx := context.Background()
+
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+
+	schema := fmt.Sprintf("fingerprinter_test_%d_%d", os.Getpid(), postgresSchemas.Add(1))
+	if _, err := conn.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn, err := pgx.Connect(ctx, dsn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close(ctx)
+		if _, err := conn.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	// settings pgx doesn't know are sent to the server, so the client only
+	// sees the new schema
+	sep := " "
+	if strings.Contains(dsn, "://") {
+		sep = "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+	}
+	db, err := storage.NewPostgresClient(ctx, dsn+sep+"search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestPostgresClient(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		if os.Getenv("CI") != "" {
+			// a CI run without a server would pass without testing anything
+			t.Fatalf("%s is not set", postgresDSNEnv)
+		}
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return newPostgresTestClient(t, dsn)
+	})
+}
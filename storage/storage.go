@@ -4,7 +4,10 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"modernc.org/sqlite"
@@ -12,68 +15,103 @@ import (
 )
 
 type Storage interface {
-	StoreFingerprints(fp map[Address]Couple) error
+	StoreFingerprints(fp []Fingerprint) error
 	GetCouples([]Address) (map[Address][]Couple, error)
 	GetSongByID(uint32) (Song, bool, error)
+	GetSongByKey(key string) (Song, bool, error)
 	RegisterSong(key string, metadata string) (uint32, error)
+	// SetProvenance records where the fingerprints of a song came from
+	SetProvenance(songID uint32, p Provenance) error
+	// DeleteSong removes a song and all of its fingerprints, it returns false
+	// if the song didn't exist
+	DeleteSong(songID uint32) (bool, error)
+	// ReplaceFingerprints replaces all fingerprints of a song with the ones
+	// given in a single step, readers see either the old or the new ones
+	ReplaceFingerprints(songID uint32, fp []Fingerprint) error
+	// ListSongs returns up to limit songs with an ID larger than afterID,
+	// ordered by ID
+	ListSongs(afterID uint32, limit int) ([]Song, error)
+	// StoreVerdict records a verdict and returns the ID it was given, the ID
+	// of v is ignored
+	StoreVerdict(v Verdict) (uint32, error)
+	// ListVerdicts returns up to limit verdicts with an ID larger than
+	// afterID, ordered by ID
+	ListVerdicts(afterID uint32, limit int) ([]Verdict, error)
+	GetSetting(key string) (string, bool, error)
+	SetSetting(key string, value string) error
 }
 
-type Address uint32
+// Address is a fingerprint hash, its layout is defined by the generator that
+// created it
+type Address uint64
 
 type Couple struct {
 	AnchorTimeMs uint32
 	SongID       uint32
 }
 
+// Fingerprint is a single occurrence of an address in a song
+type Fingerprint struct {
+	Address Address
+	Couple
+}
+
 type SQLiteClient struct {
 	db *sqlx.DB
 	mu sync.RWMutex
 }
 
+// sqlitePragmas are set on every connection, they favor ingest speed over
+// durability of the last few transactions after a power loss
+var sqlitePragmas = []string{
+	"journal_mode(WAL)",
+	"synchronous(NORMAL)",
+	"cache_size(-65536)", // 64MiB
+	"busy_timeout(5000)",
+}
+
+// withPragmas adds the sqlitePragmas to the data source name given. It also
+// makes every transaction take the write lock when it begins, a transaction
+// that reads first and writes later can otherwise fail with SQLITE_BUSY when
+// another connection wrote in between, busy_timeout doesn't help with that.
+func withPragmas(dataSourceName string) string {
+	sep := "?"
+	if strings.Contains(dataSourceName, "?") {
+		sep = "&"
+	}
+	for _, pragma := range sqlitePragmas {
+		dataSourceName += sep + "_pragma=" + pragma
+		sep = "&"
+	}
+	return dataSourceName + "&_txlock=immediate"
+}
+
 func NewSQLiteClient(dataSourceName string) (*SQLiteClient, error) {
-	db, err := sqlx.Open("sqlite", dataSourceName)
+	db, err := sqlx.Open("sqlite", withPragmas(dataSourceName))
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to SQLite: %s", err)
 	}
 
-	err = createTables(db)
+	err = migrate(db)
 	if err != nil {
-		return nil, fmt.Errorf("error creating tables: %s", err)
+		db.Close()
+		return nil, fmt.Errorf("error migrating database: %w", err)
 	}
 
 	return &SQLiteClient{db: db}, nil
 }
 
-// createTables creates the required tables if they don't exist
-func createTables(db *sqlx.DB) error {
-	createSongsTable := `
-    CREATE TABLE IF NOT EXISTS songs (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		song TEXT NOT NULL,
-		key TEXT NOT NULL UNIQUE
-    );
-    `
-
-	createFingerprintsTable := `
-    CREATE TABLE IF NOT EXISTS fingerprints (
-        address INTEGER NOT NULL,
-        anchorTimeMs INTEGER NOT NULL,
-        songID INTEGER NOT NULL,
-        PRIMARY KEY (address, anchorTimeMs, songID)
-    );
-    `
+// songColumns are the columns scanSong expects, in order
+const songColumns = "id, song, key, filePath, durationMs, sampleRate, contentHash, hashCount, paramsVersion"
 
-	_, err := db.Exec(createSongsTable)
-	if err != nil {
-		return fmt.Errorf("error creating songs table: %s", err)
-	}
-
-	_, err = db.Exec(createFingerprintsTable)
-	if err != nil {
-		return fmt.Errorf("error creating fingerprints table: %s", err)
-	}
-
-	return nil
+// scanSong scans a row selected with songColumns
+func scanSong(row interface{ Scan(...any) error }) (Song, error) {
+	var song Song
+	var durationMs int64
+	err := row.Scan(&song.ID, &song.Metadata, &song.Key, &song.FilePath, &durationMs,
+		&song.SampleRate, &song.ContentHash, &song.HashCount, &song.ParamsVersion)
+	song.Duration = time.Duration(durationMs) * time.Millisecond
+	return song, err
 }
 
 func (db *SQLiteClient) Close() error {
@@ -83,7 +121,21 @@ func (db *SQLiteClient) Close() error {
 	return nil
 }
 
-func (db *SQLiteClient) StoreFingerprints(fingerprints map[Address]Couple) error {
+// storeFingerprintsBatchSize is the amount of rows inserted per statement,
+// each row uses three parameters
+const storeFingerprintsBatchSize = 256
+
+// insertFingerprintsQuery returns an INSERT statement for n rows
+func insertFingerprintsQuery(n int) string {
+	return "INSERT OR REPLACE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)" +
+		strings.Repeat(", (?, ?, ?)", n-1)
+}
+
+func (db *SQLiteClient) StoreFingerprints(fingerprints []Fingerprint) error {
+	if len(fingerprints) == 0 {
+		return nil
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
@@ -93,44 +145,132 @@ func (db *SQLiteClient) StoreFingerprints(fingerprints map[Address]Couple) error
 	}
 	defer tx.Rollback()
 
-	query := `INSERT OR REPLACE INTO fingerprints (address, anchorTimeMs, songID) VALUES (?, ?, ?)`
-	for address, couple := range fingerprints {
-		//fmt.Println(address, couple.AnchorTimeMs, couple.SongID)
-		if _, err := tx.Exec(query, address, couple.AnchorTimeMs, couple.SongID); err != nil {
-			return fmt.Errorf("error executing statement: %w", err)
+	if err := insertFingerprints(tx, fingerprints); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ErrWrongSong is returned by ReplaceFingerprints when a fingerprint belongs
+// to another song
+var ErrWrongSong = errors.New("fingerprint belongs to another song")
+
+func (db *SQLiteClient) ReplaceFingerprints(songID uint32, fingerprints []Fingerprint) error {
+	for _, fp := range fingerprints {
+		if fp.SongID != songID {
+			return fmt.Errorf("%w: song %d instead of %d", ErrWrongSong, fp.SongID, songID)
 		}
 	}
 
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	tx, err := db.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM fingerprints WHERE songID = ?", songID); err != nil {
+		return fmt.Errorf("error deleting fingerprints: %w", err)
+	}
+
+	if err := insertFingerprints(tx, fingerprints); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
+// insertFingerprints inserts the fingerprints given in batches of
+// storeFingerprintsBatchSize
+func insertFingerprints(tx *sqlx.Tx, fingerprints []Fingerprint) error {
+	var err error
+	var stmt *sqlx.Stmt
+	if len(fingerprints) >= storeFingerprintsBatchSize {
+		stmt, err = tx.Preparex(insertFingerprintsQuery(storeFingerprintsBatchSize))
+		if err != nil {
+			return fmt.Errorf("error preparing statement: %w", err)
+		}
+		defer stmt.Close()
+	}
+
+	args := make([]any, 0, storeFingerprintsBatchSize*3)
+	for start := 0; start < len(fingerprints); start += storeFingerprintsBatchSize {
+		batch := fingerprints[start:min(start+storeFingerprintsBatchSize, len(fingerprints))]
+
+		args = args[:0]
+		for _, fp := range batch {
+			args = append(args, fp.Address, fp.AnchorTimeMs, fp.SongID)
+		}
+
+		if len(batch) == storeFingerprintsBatchSize {
+			_, err = stmt.Exec(args...)
+		} else {
+			_, err = tx.Exec(insertFingerprintsQuery(len(batch)), args...)
+		}
+		if err != nil {
+			return fmt.Errorf("error executing statement: %w", err)
+		}
+	}
+	return nil
+}
+
+// getCouplesBatchSize is the amount of addresses looked up per query, this
+// has to stay below the SQLite limit on the amount of parameters
+const getCouplesBatchSize = 500
+
 func (db *SQLiteClient) GetCouples(addresses []Address) (map[Address][]Couple, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	couples := make(map[Address][]Couple)
+	couples := make(map[Address][]Couple, len(addresses))
 
-	for _, address := range addresses {
-		rows, err := db.db.Query("SELECT anchorTimeMs, songID FROM fingerprints WHERE address = ?", address)
-		if err != nil {
-			return nil, fmt.Errorf("error querying database: %s", err)
+	// an address that ends up in two batches would have its couples added
+	// twice, sorting also makes the batches visit the index in order
+	addresses = slices.Compact(slices.Sorted(slices.Values(addresses)))
+
+	args := make([]any, 0, getCouplesBatchSize)
+	for start := 0; start < len(addresses); start += getCouplesBatchSize {
+		batch := addresses[start:min(start+getCouplesBatchSize, len(addresses))]
+
+		args = args[:0]
+		for _, address := range batch {
+			args = append(args, address)
 		}
-		defer rows.Close()
-
-		var docCouples []Couple
-		for rows.Next() {
-			var couple Couple
-			if err := rows.Scan(&couple.AnchorTimeMs, &couple.SongID); err != nil {
-				return nil, fmt.Errorf("error scanning row: %s", err)
-			}
-			docCouples = append(docCouples, couple)
+
+		query := "SELECT address, anchorTimeMs, songID FROM fingerprints WHERE address IN (?" +
+			strings.Repeat(",?", len(batch)-1) + ")"
+		if err := db.queryCouples(couples, query, args...); err != nil {
+			return nil, err
 		}
-		couples[address] = docCouples
 	}
 
 	return couples, nil
 }
 
+// queryCouples runs the query given and adds the (address, anchorTimeMs,
+// songID) rows it returns to couples
+func (db *SQLiteClient) queryCouples(couples map[Address][]Couple, query string, args ...any) error {
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("error querying database: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var address Address
+		var couple Couple
+		if err := rows.Scan(&address, &couple.AnchorTimeMs, &couple.SongID); err != nil {
+			return fmt.Errorf("error scanning row: %s", err)
+		}
+		couples[address] = append(couples[address], couple)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading rows: %s", err)
+	}
+	return nil
+}
+
 func (db *SQLiteClient) RegisterSong(key string, metadata string) (uint32, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
@@ -163,12 +303,11 @@ func (s *SQLiteClient) GetSongByID(songId uint32) (Song, bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	query := "SELECT id, song, key FROM songs WHERE id = ?"
+	query := "SELECT " + songColumns + " FROM songs WHERE id = ?"
 
 	row := s.db.QueryRow(query, songId)
 
-	var song Song
-	err := row.Scan(&song.ID, &song.Metadata, &song.Key)
+	song, err := scanSong(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return Song{}, false, nil
@@ -179,8 +318,227 @@ func (s *SQLiteClient) GetSongByID(songId uint32) (Song, bool, error) {
 	return song, true, nil
 }
 
+// GetSongByKey retrieves a song by its key
+func (s *SQLiteClient) GetSongByKey(key string) (Song, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	song, err := scanSong(s.db.QueryRow("SELECT "+songColumns+" FROM songs WHERE key = ?", key))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Song{}, false, nil
+		}
+		return Song{}, false, fmt.Errorf("failed to retrieve song: %s", err)
+	}
+
+	return song, true, nil
+}
+
+func (s *SQLiteClient) SetProvenance(songID uint32, p Provenance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec(`UPDATE songs SET filePath = ?, durationMs = ?, sampleRate = ?,
+		contentHash = ?, hashCount = ?, paramsVersion = ? WHERE id = ?`,
+		p.FilePath, p.Duration.Milliseconds(), p.SampleRate,
+		p.ContentHash, p.HashCount, p.ParamsVersion, songID)
+	if err != nil {
+		return fmt.Errorf("error executing statement: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteClient) DeleteSong(songID uint32) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM songs WHERE id = ?", songID)
+	if err != nil {
+		return false, fmt.Errorf("error deleting song: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error getting affected rows: %w", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM fingerprints WHERE songID = ?", songID); err != nil {
+		return false, fmt.Errorf("error deleting fingerprints: %w", err)
+	}
+
+	return n > 0, tx.Commit()
+}
+
+func (s *SQLiteClient) ListSongs(afterID uint32, limit int) ([]Song, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query("SELECT "+songColumns+" FROM songs WHERE id > ? ORDER BY id LIMIT ?", afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %s", err)
+	}
+	defer rows.Close()
+
+	var songs []Song
+	for rows.Next() {
+		song, err := scanSong(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		songs = append(songs, song)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %s", err)
+	}
+	return songs, nil
+}
+
+// verdictColumns are the columns scanVerdict expects, in order
+const verdictColumns = "id, station, title, songID, metadata, outcome, confidence, startedAt, endedAt"
+
+// scanVerdict scans a row selected with verdictColumns
+func scanVerdict(row interface{ Scan(...any) error }) (Verdict, error) {
+	var v Verdict
+	var startedAt, endedAt int64
+	err := row.Scan(&v.ID, &v.Station, &v.Title, &v.SongID, &v.Metadata,
+		&v.Outcome, &v.Confidence, &startedAt, &endedAt)
+	v.Start, v.End = time.UnixMilli(startedAt), time.UnixMilli(endedAt)
+	return v, err
+}
+
+func (s *SQLiteClient) StoreVerdict(v Verdict) (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.db.Exec(`INSERT INTO verdicts (station, title, songID, metadata, outcome,
+		confidence, startedAt, endedAt) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		v.Station, v.Title, v.SongID, v.Metadata, v.Outcome,
+		v.Confidence, v.Start.UnixMilli(), v.End.UnixMilli())
+	if err != nil {
+		return 0, fmt.Errorf("error executing statement: %w", err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error getting last insert id: %w", err)
+	}
+	return uint32(id), nil
+}
+
+func (s *SQLiteClient) ListVerdicts(afterID uint32, limit int) ([]Verdict, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rows, err := s.db.Query("SELECT "+verdictColumns+" FROM verdicts WHERE id > ? ORDER BY id LIMIT ?", afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database: %s", err)
+	}
+	defer rows.Close()
+
+	var verdicts []Verdict
+	for rows.Next() {
+		v, err := scanVerdict(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning row: %s", err)
+		}
+		verdicts = append(verdicts, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading rows: %s", err)
+	}
+	return verdicts, nil
+}
+
+// GetSetting retrieves the value of the setting with the key given
+func (s *SQLiteClient) GetSetting(key string) (string, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var value string
+	err := s.db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("failed to retrieve setting: %s", err)
+	}
+
+	return value, true, nil
+}
+
+// SetSetting sets the value of the setting with the key given
+func (s *SQLiteClient) SetSetting(key string, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec("INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)", key, value)
+	if err != nil {
+		return fmt.Errorf("error executing statement: %w", err)
+	}
+	return nil
+}
+
 type Song struct {
 	ID       uint32
 	Key      string
 	Metadata string
+	Provenance
+}
+
+// Provenance describes the file the fingerprints of a song were generated
+// from, and how. The zero value means it is unknown.
+type Provenance struct {
+	// FilePath is the path of the file at the time it was fingerprinted
+	FilePath string
+	// Duration is the length of the audio
+	Duration time.Duration
+	// SampleRate is the sample rate the audio was decoded at
+	SampleRate int
+	// ContentHash identifies the contents of the file, a file whose hash
+	// changed has to be fingerprinted again
+	ContentHash string
+	// HashCount is the amount of fingerprints stored
+	HashCount int
+	// ParamsVersion identifies the parameters the fingerprints were
+	// generated with
+	ParamsVersion string
+}
+
+// Outcome is the result of comparing an announced title with the song that
+// was identified
+type Outcome string
+
+const (
+	// OutcomeAgreement means the identified song looks like the title
+	OutcomeAgreement Outcome = "agreement"
+	// OutcomeMismatch means another song than the announced one was
+	// identified
+	OutcomeMismatch Outcome = "mismatch"
+	// OutcomeUnknown means no song was identified, either because the song
+	// isn't known or because the audio matched nothing well enough
+	OutcomeUnknown Outcome = "unknown"
+)
+
+// Verdict records whether the title a station announced agreed with the song
+// identified while it was current
+type Verdict struct {
+	ID uint32
+	// Station identifies the stream, usually by its URL
+	Station string
+	// Title is the announced title
+	Title string
+	// SongID and Metadata are of the identified song, SongID is 0 if the
+	// outcome is unknown
+	SongID   uint32
+	Metadata string
+	Outcome  Outcome
+	// Confidence is how sure the identification was, between 0 and 1
+	Confidence float64
+	// Start and End are when the title was current
+	Start, End time.Time
 }
@@ -0,0 +1,141 @@
+package storage_test
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"path/filepath"
+	"testing"
+
+	"github.com/Wessie/fingerprinter/storage"
+	"github.com/Wessie/fingerprinter/storage/storagetest"
+)
+
+// newSQLiteTestClient returns a SQLiteClient on a new database file that is
+// removed when the test is done
+func newSQLiteTestClient(t testing.TB) *storage.SQLiteClient {
+	t.Helper()
+	db, err := storage.NewSQLiteClient(filepath.Join(t.TempDir(), "test.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLiteClient(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return newSQLiteTestClient(t)
+	})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewMemoryStorage()
+	})
+}
+
+func TestIndexStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return newIndexTestStorage(t)
+	})
+}
+
+func TestIndexStorageFromFile(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return reopenIndex(t, newIndexTestStorage(t))
+	})
+}
+
+func newIndexTestStorage(t *testing.T) *storage.IndexStorage {
+	t.Helper()
+	s, err := storage.NewIndexStorage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// reopenIndex writes s to an index file and returns a new IndexStorage on top
+// of it, the file is closed when the test is done
+func reopenIndex(t *testing.T, s *storage.IndexStorage) *storage.IndexStorage {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.fpix")
+	if err := s.WriteIndex(path); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := storage.OpenIndexStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reopened.Close() })
+	return reopened
+}
+
+// fillSongs registers songs with hashes random fingerprints each in s and
+// returns the addresses it stored
+func fillSongs(t testing.TB, s storage.Storage, songs, hashes int) []storage.Address {
+	t.Helper()
+	r := rand.New(rand.NewPCG(uint64(songs), uint64(hashes)))
+
+	addresses := make([]storage.Address, 0, songs*hashes)
+	var fingerprints []storage.Fingerprint
+	for i := range songs {
+		id, err := s.RegisterSong(fmt.Sprintf("key%d", i), fmt.Sprintf("song %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range hashes {
+			fp := storage.Fingerprint{
+				Address: storage.Address(r.Uint32()),
+				Couple:  storage.Couple{AnchorTimeMs: uint32(j * 50), SongID: id},
+			}
+			fingerprints = append(fingerprints, fp)
+			addresses = append(addresses, fp.Address)
+		}
+
+		// storing many songs at once keeps large fixtures fast
+		if len(fingerprints) >= 100000 || i == songs-1 {
+			if err := s.StoreFingerprints(fingerprints); err != nil {
+				t.Fatal(err)
+			}
+			fingerprints = fingerprints[:0]
+		}
+	}
+	return addresses
+}
+
+func BenchmarkGetCouples(b *testing.B) {
+	db := newSQLiteTestClient(b)
+	stored := fillSongs(b, db, 10000, 500)
+
+	// half of the addresses looked up are in the database
+	r := rand.New(rand.NewPCG(1, 2))
+	addresses := make([]storage.Address, 10000)
+	for i := range addresses {
+		if i%2 == 0 {
+			addresses[i] = stored[r.IntN(len(stored))]
+		} else {
+			addresses[i] = storage.Address(r.Uint32())
+		}
+	}
+
+	b.Run("batched", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := db.GetCouples(addresses); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// what GetCouples did before it batched the addresses
+	b.Run("per address", func(b *testing.B) {
+		for b.Loop() {
+			for _, address := range addresses {
+				if _, err := db.GetCouples([]storage.Address{address}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
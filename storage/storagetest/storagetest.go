@@ -0,0 +1,753 @@
+// Package storagetest checks that an implementation of storage.Storage
+// behaves the way the generator and the CLI expect it to.
+//
+// A backend runs it from its own tests:
+//
+//	func TestStorage(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) storage.Storage {
+//			return NewMemoryStorage()
+//		})
+//	}
+//
+// Same and Equal compare two implementations with each other, so a backend
+// can be checked against one that is known to be right.
+package storagetest
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Wessie/fingerprinter/storage"
+)
+
+// Factory returns a new and empty storage, anything that has to be cleaned up
+// afterwards should be registered with t.Cleanup
+type Factory func(t *testing.T) storage.Storage
+
+// Run runs the conformance tests against storages created by factory, every
+// test gets its own storage
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, storage.Storage)
+	}{
+		{"RegisterSong", testRegisterSong},
+		{"DuplicateKey", testDuplicateKey},
+		{"MissingSong", testMissingSong},
+		{"GetSongByKey", testGetSongByKey},
+		{"Provenance", testProvenance},
+		{"DeleteSong", testDeleteSong},
+		{"ReplaceFingerprints", testReplaceFingerprints},
+		{"ListSongs", testListSongs},
+		{"Fingerprints", testFingerprints},
+		{"DuplicateFingerprints", testDuplicateFingerprints},
+		{"Settings", testSettings},
+		{"Verdicts", testVerdicts},
+		{"Concurrent", testConcurrent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.fn(t, factory(t))
+		})
+	}
+}
+
+func mustRegister(t *testing.T, s storage.Storage, key, metadata string) uint32 {
+	t.Helper()
+
+	id, err := s.RegisterSong(key, metadata)
+	if err != nil {
+		t.Fatalf("RegisterSong(%q): %v", key, err)
+	}
+	if id == 0 {
+		t.Fatalf("RegisterSong(%q) returned id 0 for a new key", key)
+	}
+	return id
+}
+
+func testRegisterSong(t *testing.T, s storage.Storage) {
+	a := mustRegister(t, s, "key-a", "Artist - A")
+	b := mustRegister(t, s, "key-b", "Artist - B")
+	if a == b {
+		t.Fatalf("two songs got the same id %d", a)
+	}
+
+	for id, want := range map[uint32]storage.Song{
+		a: {ID: a, Key: "key-a", Metadata: "Artist - A"},
+		b: {ID: b, Key: "key-b", Metadata: "Artist - B"},
+	} {
+		song, ok, err := s.GetSongByID(id)
+		if err != nil || !ok {
+			t.Fatalf("GetSongByID(%d) = %v, %v", id, ok, err)
+		}
+		if song != want {
+			t.Errorf("GetSongByID(%d) = %+v, want %+v", id, song, want)
+		}
+	}
+}
+
+func testDuplicateKey(t *testing.T, s storage.Storage) {
+	id := mustRegister(t, s, "key", "first")
+
+	// the CLI depends on this to skip songs it already knows
+	dup, err := s.RegisterSong("key", "second")
+	if err != nil {
+		t.Fatalf("RegisterSong with a duplicate key: %v", err)
+	}
+	if dup != 0 {
+		t.Fatalf("RegisterSong with a duplicate key returned id %d, want 0", dup)
+	}
+
+	song, ok, err := s.GetSongByID(id)
+	if err != nil || !ok {
+		t.Fatalf("GetSongByID(%d) = %v, %v", id, ok, err)
+	}
+	if song.Metadata != "first" {
+		t.Errorf("duplicate key changed the metadata to %q", song.Metadata)
+	}
+}
+
+func testMissingSong(t *testing.T, s storage.Storage) {
+	id := mustRegister(t, s, "key", "metadata")
+
+	for _, missing := range []uint32{0, id + 1, 1<<32 - 1} {
+		song, ok, err := s.GetSongByID(missing)
+		if err != nil {
+			t.Errorf("GetSongByID(%d) of a missing song: %v", missing, err)
+		}
+		if ok {
+			t.Errorf("GetSongByID(%d) of a missing song returned %+v", missing, song)
+		}
+	}
+}
+
+func testGetSongByKey(t *testing.T, s storage.Storage) {
+	id := mustRegister(t, s, "key", "metadata")
+
+	song, ok, err := s.GetSongByKey("key")
+	if err != nil || !ok {
+		t.Fatalf("GetSongByKey = %v, %v", ok, err)
+	}
+	if want := (storage.Song{ID: id, Key: "key", Metadata: "metadata"}); song != want {
+		t.Errorf("GetSongByKey = %+v, want %+v", song, want)
+	}
+
+	if song, ok, err := s.GetSongByKey("missing"); err != nil || ok {
+		t.Errorf("GetSongByKey of a missing key = %+v, %v, %v", song, ok, err)
+	}
+}
+
+func testProvenance(t *testing.T, s storage.Storage) {
+	id := mustRegister(t, s, "key", "metadata")
+
+	song, _, err := s.GetSongByID(id)
+	if err != nil {
+		t.Fatalf("GetSongByID: %v", err)
+	}
+	if song.Provenance != (storage.Provenance{}) {
+		t.Errorf("new song has provenance %+v", song.Provenance)
+	}
+
+	want := storage.Provenance{
+		FilePath:      "/music/song.mp3",
+		Duration:      3*time.Minute + 25*time.Second + 120*time.Millisecond,
+		SampleRate:    44100,
+		ContentHash:   "0123456789abcdef",
+		HashCount:     123456,
+		ParamsVersion: "params",
+	}
+	if err := s.SetProvenance(id, want); err != nil {
+		t.Fatalf("SetProvenance: %v", err)
+	}
+
+	song, _, err = s.GetSongByID(id)
+	if err != nil {
+		t.Fatalf("GetSongByID: %v", err)
+	}
+	if song.Provenance != want {
+		t.Errorf("GetSongByID provenance = %+v, want %+v", song.Provenance, want)
+	}
+
+	song, _, err = s.GetSongByKey("key")
+	if err != nil {
+		t.Fatalf("GetSongByKey: %v", err)
+	}
+	if song.Provenance != want {
+		t.Errorf("GetSongByKey provenance = %+v, want %+v", song.Provenance, want)
+	}
+
+	songs, err := s.ListSongs(0, 1)
+	if err != nil || len(songs) != 1 {
+		t.Fatalf("ListSongs = %d songs, %v", len(songs), err)
+	}
+	if songs[0].Provenance != want {
+		t.Errorf("ListSongs provenance = %+v, want %+v", songs[0].Provenance, want)
+	}
+}
+
+func testDeleteSong(t *testing.T, s storage.Storage) {
+	a := mustRegister(t, s, "key-a", "a")
+	b := mustRegister(t, s, "key-b", "b")
+
+	fpsA, fpsB := fingerprints(a, 200), fingerprints(b, 200)
+	if err := s.StoreFingerprints(append(slices.Clone(fpsA), fpsB...)); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+
+	ok, err := s.DeleteSong(a)
+	if err != nil || !ok {
+		t.Fatalf("DeleteSong = %v, %v", ok, err)
+	}
+	if ok, err := s.DeleteSong(a); err != nil || ok {
+		t.Errorf("DeleteSong of a deleted song = %v, %v", ok, err)
+	}
+
+	if song, ok, err := s.GetSongByID(a); err != nil || ok {
+		t.Errorf("GetSongByID of a deleted song = %+v, %v, %v", song, ok, err)
+	}
+
+	// only the fingerprints of the other song are left
+	addresses := slices.Collect(maps.Keys(group(fpsA)))
+	addresses = append(addresses, slices.Collect(maps.Keys(group(fpsB)))...)
+	got, err := s.GetCouples(addresses)
+	if err != nil {
+		t.Fatalf("GetCouples: %v", err)
+	}
+	checkCouples(t, got, group(fpsB))
+
+	// the key can be registered again, but never under the old ID
+	again := mustRegister(t, s, "key-a", "a")
+	if again == a {
+		t.Errorf("RegisterSong reused the ID %d of a deleted song", a)
+	}
+}
+
+func testReplaceFingerprints(t *testing.T, s storage.Storage) {
+	a := mustRegister(t, s, "key-a", "a")
+	b := mustRegister(t, s, "key-b", "b")
+
+	old, other := fingerprints(a, 300), fingerprints(b, 100)
+	if err := s.StoreFingerprints(append(slices.Clone(old), other...)); err != nil {
+		t.Fatalf("StoreFingerprints: %v", err)
+	}
+
+	// shift the times so the new fingerprints differ from the old ones
+	replacement := fingerprints(a, 150)
+	for i := range replacement {
+		replacement[i].AnchorTimeMs += 5
+	}
+	if err := s.ReplaceFingerprints(a, replacement); err != nil {
+		t.Fatalf("ReplaceFingerprints: %v", err)
+	}
+
+	if err := s.ReplaceFingerprints(a, other); err == nil {
+		t.Errorf("ReplaceFingerprints accepted fingerprints of another song")
+	}
+
+	var addresses []storage.Address
+	for _, fps := range [][]storage.Fingerprint{old, other, replacement} {
+		addresses = append(addresses, slices.Collect(maps.Keys(group(fps)))...)
+	}
+	got, err := s.GetCouples(addresses)
+	if err != nil {
+		t.Fatalf("GetCouples: %v", err)
+	}
+	checkCouples(t, got, group(append(slices.Clone(replacement), other...)))
+
+	// replacing with nothing removes them all
+	if err := s.ReplaceFingerprints(a, nil); err != nil {
+		t.Fatalf("ReplaceFingerprints: %v", err)
+	}
+	got, err = s.GetCouples(addresses)
+	if err != nil {
+		t.Fatalf("GetCouples: %v", err)
+	}
+	checkCouples(t, got, group(other))
+}
+
+func testListSongs(t *testing.T, s storage.Storage) {
+	var want []storage.Song
+	for i := range 25 {
+		key := fmt.Sprintf("key-%d", i)
+		want = append(want, storage.Song{ID: mustRegister(t, s, key, "metadata"), Key: key, Metadata: "metadata"})
+	}
+
+	// a deleted song is skipped
+	if _, err := s.DeleteSong(want[3].ID); err != nil {
+		t.Fatalf("DeleteSong: %v", err)
+	}
+	want = slices.Delete(want, 3, 4)
+
+	var got []storage.Song
+	var pages int
+	for after := uint32(0); ; pages++ {
+		page, err := s.ListSongs(after, 10)
+		if err != nil {
+			t.Fatalf("ListSongs: %v", err)
+		}
+		if len(page) > 10 {
+			t.Fatalf("ListSongs returned %d songs, more than the limit of 10", len(page))
+		}
+		if len(page) == 0 {
+			break
+		}
+		got = append(got, page...)
+		after = page[len(page)-1].ID
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("ListSongs = %+v, want %+v", got, want)
+	}
+	if pages != 3 {
+		t.Errorf("ListSongs took %d pages, want 3", pages)
+	}
+}
+
+// fingerprints returns n fingerprints for the song given, the addresses use
+// the whole range of both hash codecs
+func fingerprints(songID uint32, n int) []storage.Fingerprint {
+	fps := make([]storage.Fingerprint, n)
+	for i := range fps {
+		fps[i] = storage.Fingerprint{
+			Address: storage.Address(i%(n/2+1)) << (i % 40),
+			Couple: storage.Couple{
+				AnchorTimeMs: uint32(i * 37),
+				SongID:       songID,
+			},
+		}
+	}
+	return fps
+}
+
+// group returns the couples of every address in fps
+func group(fps []storage.Fingerprint) map[storage.Address][]storage.Couple {
+	couples := map[storage.Address][]storage.Couple{}
+	for _, fp := range fps {
+		couples[fp.Address] = append(couples[fp.Address], fp.Couple)
+	}
+	return couples
+}
+
+func compareCouples(a, b storage.Couple) int {
+	return cmp.Or(cmp.Compare(a.SongID, b.SongID), cmp.Compare(a.AnchorTimeMs, b.AnchorTimeMs))
+}
+
+// checkCouples compares the result of GetCouples against want, the order of
+// the couples of an address isn't part of the interface
+func checkCouples(t *testing.T, got, want map[storage.Address][]storage.Couple) {
+	t.Helper()
+
+	for _, address := range slices.Sorted(maps.Keys(want)) {
+		w := slices.SortedFunc(slices.Values(want[address]), compareCouples)
+		g := slices.SortedFunc(slices.Values(got[address]), compareCouples)
+		if !slices.Equal(g, w) {
+			t.Errorf("couples of address %#x = %v, want %v", address, g, w)
+		}
+	}
+	for address, couples := range got {
+		if _, ok := want[address]; !ok {
+			t.Errorf("unexpected address %#x with couples %v", address, couples)
+		}
+	}
+}
+
+func testFingerprints(t *testing.T, s storage.Storage) {
+	a := mustRegister(t, s, "key-a", "a")
+	b := mustRegister(t, s, "key-b", "b")
+
+	fpsA := fingerprints(a, 1000)
+	fpsB := fingerprints(b, 300)
+	for _, fps := range [][]storage.Fingerprint{fpsA, fpsB, nil} {
+		if err := s.StoreFingerprints(fps); err != nil {
+			t.Fatalf("StoreFingerprints: %v", err)
+		}
+	}
+
+	want := group(append(slices.Clone(fpsA), fpsB...))
+
+	// ask for every address plus some that were never stored
+	addresses := slices.Collect(maps.Keys(want))
+	addresses = append(addresses, 1<<56-1, 0xdead)
+	delete(want, 1<<56-1)
+	delete(want, 0xdead)
+
+	got, err := s.GetCouples(addresses)
+	if err != nil {
+		t.Fatalf("GetCouples: %v", err)
+	}
+	checkCouples(t, got, want)
+
+	got, err = s.GetCouples(nil)
+	if err != nil {
+		t.Fatalf("GetCouples without addresses: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("GetCouples without addresses returned %d addresses", len(got))
+	}
+}
+
+func testDuplicateFingerprints(t *testing.T, s storage.Storage) {
+	id := mustRegister(t, s, "key", "metadata")
+
+	fps := fingerprints(id, 100)
+	for range 2 {
+		if err := s.StoreFingerprints(fps); err != nil {
+			t.Fatalf("StoreFingerprints: %v", err)
+		}
+	}
+
+	// storing the same fingerprint twice keeps a single copy
+	want := map[storage.Address][]storage.Couple{}
+	for _, fp := range fps {
+		if !slices.Contains(want[fp.Address], fp.Couple) {
+			want[fp.Address] = append(want[fp.Address], fp.Couple)
+		}
+	}
+
+	got, err := s.GetCouples(slices.Collect(maps.Keys(want)))
+	if err != nil {
+		t.Fatalf("GetCouples: %v", err)
+	}
+	checkCouples(t, got, want)
+}
+
+func testSettings(t *testing.T, s storage.Storage) {
+	if value, ok, err := s.GetSetting("missing"); err != nil || ok {
+		t.Fatalf("GetSetting of a missing key = %q, %v, %v", value, ok, err)
+	}
+
+	for _, value := range []string{"1", "2", ""} {
+		if err := s.SetSetting("key", value); err != nil {
+			t.Fatalf("SetSetting: %v", err)
+		}
+		got, ok, err := s.GetSetting("key")
+		if err != nil || !ok || got != value {
+			t.Fatalf("GetSetting = %q, %v, %v, want %q", got, ok, err, value)
+		}
+	}
+}
+
+func testVerdicts(t *testing.T, s storage.Storage) {
+	start := time.UnixMilli(1700000000000)
+
+	var want []storage.Verdict
+	for i := range 15 {
+		v := storage.Verdict{
+			Station: "http://example.com/main.mp3",
+			Title:   fmt.Sprintf("title %d", i),
+			Outcome: storage.OutcomeUnknown,
+			Start:   start.Add(time.Duration(i) * time.Minute),
+			End:     start.Add(time.Duration(i+1) * time.Minute),
+		}
+		if i%3 != 0 {
+			v.SongID, v.Metadata = uint32(i), fmt.Sprintf("song %d", i)
+			v.Outcome, v.Confidence = storage.OutcomeAgreement, 0.75
+			if i%3 == 2 {
+				v.Outcome = storage.OutcomeMismatch
+			}
+		}
+
+		id, err := s.StoreVerdict(v)
+		if err != nil {
+			t.Fatalf("StoreVerdict: %v", err)
+		}
+		if len(want) > 0 && id <= want[len(want)-1].ID {
+			t.Fatalf("StoreVerdict returned ID %d after %d", id, want[len(want)-1].ID)
+		}
+		v.ID = id
+		want = append(want, v)
+	}
+
+	var got []storage.Verdict
+	for after := uint32(0); ; {
+		page, err := s.ListVerdicts(after, 10)
+		if err != nil {
+			t.Fatalf("ListVerdicts: %v", err)
+		}
+		if len(page) > 10 {
+			t.Fatalf("ListVerdicts returned %d verdicts, more than the limit of 10", len(page))
+		}
+		if len(page) == 0 {
+			break
+		}
+		got = append(got, page...)
+		after = page[len(page)-1].ID
+	}
+
+	equal := func(a, b storage.Verdict) bool {
+		return a.ID == b.ID && a.Station == b.Station && a.Title == b.Title &&
+			a.SongID == b.SongID && a.Metadata == b.Metadata && a.Outcome == b.Outcome &&
+			a.Confidence == b.Confidence && a.Start.Equal(b.Start) && a.End.Equal(b.End)
+	}
+	if !slices.EqualFunc(got, want, equal) {
+		t.Errorf("ListVerdicts = %+v, want %+v", got, want)
+	}
+}
+
+func testConcurrent(t *testing.T, s storage.Storage) {
+	const workers = 8
+
+	ids := make([]uint32, workers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(2)
+
+		// writer
+		go func() {
+			defer wg.Done()
+
+			id, err := s.RegisterSong(fmt.Sprintf("key-%d", i), "metadata")
+			if err != nil || id == 0 {
+				t.Errorf("RegisterSong = %d, %v", id, err)
+				return
+			}
+			ids[i] = id
+
+			fps := fingerprints(id, 500)
+			for chunk := range slices.Chunk(fps, 50) {
+				if err := s.StoreFingerprints(chunk); err != nil {
+					t.Errorf("StoreFingerprints: %v", err)
+					return
+				}
+			}
+		}()
+
+		// reader
+		go func() {
+			defer wg.Done()
+
+			addresses := slices.Collect(maps.Keys(group(fingerprints(0, 500))))
+			for range 20 {
+				if _, err := s.GetCouples(addresses); err != nil {
+					t.Errorf("GetCouples: %v", err)
+					return
+				}
+				if _, _, err := s.GetSongByID(uint32(i + 1)); err != nil {
+					t.Errorf("GetSongByID: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	var all []storage.Fingerprint
+	for _, id := range ids {
+		all = append(all, fingerprints(id, 500)...)
+	}
+	want := group(all)
+
+	got, err := s.GetCouples(slices.Collect(maps.Keys(want)))
+	if err != nil {
+		t.Fatalf("GetCouples: %v", err)
+	}
+	checkCouples(t, got, want)
+}
+
+// sameKeys, sameSettings and sameAddresses are what the operations of Same
+// pick from, few enough that keys and fingerprints collide
+var (
+	sameKeys      = []string{"key-0", "key-1", "key-2", "key-3", "key-4", "key-5", "key-6", "key-7"}
+	sameSettings  = []string{"setting-a", "setting-b", "setting-c"}
+	sameAddresses = func() []storage.Address {
+		var addresses []storage.Address
+		for i := range 48 {
+			addresses = append(addresses, storage.Address(i+1)<<(i%40))
+		}
+		return addresses
+	}()
+)
+
+// Same runs a random sequence of operations picked by seed against both a and
+// b, which have to start out empty, and checks that every operation gives the
+// same result on both. Afterwards their contents are compared with Equal.
+func Same(t *testing.T, a, b storage.Storage, seed uint64) {
+	t.Helper()
+	r := rand.New(rand.NewPCG(seed, 0x5a3e))
+
+	var ids []uint32
+	song := func() uint32 {
+		if len(ids) == 0 || r.IntN(10) == 0 {
+			// a song that doesn't exist
+			return 1<<32 - 1
+		}
+		return ids[r.IntN(len(ids))]
+	}
+	fps := func(songID uint32) []storage.Fingerprint {
+		fps := make([]storage.Fingerprint, r.IntN(20))
+		for i := range fps {
+			fps[i] = storage.Fingerprint{
+				Address: sameAddresses[r.IntN(len(sameAddresses))],
+				Couple:  storage.Couple{AnchorTimeMs: uint32(r.IntN(20) * 50), SongID: songID},
+			}
+		}
+		return fps
+	}
+
+	for i := range 300 {
+		var op string
+		var fn func(s storage.Storage) string
+		switch r.IntN(10) {
+		case 0:
+			key := sameKeys[r.IntN(len(sameKeys))]
+			metadata := fmt.Sprintf("metadata %d", i)
+			op = fmt.Sprintf("RegisterSong(%q, %q)", key, metadata)
+			fn = func(s storage.Storage) string {
+				id, err := s.RegisterSong(key, metadata)
+				return result(id, err)
+			}
+		case 1, 2:
+			fps := fps(song())
+			op = fmt.Sprintf("StoreFingerprints(%v)", fps)
+			fn = func(s storage.Storage) string {
+				return result(nil, s.StoreFingerprints(fps))
+			}
+		case 3:
+			id := song()
+			fps := fps(id)
+			op = fmt.Sprintf("ReplaceFingerprints(%d, %v)", id, fps)
+			fn = func(s storage.Storage) string {
+				return result(nil, s.ReplaceFingerprints(id, fps))
+			}
+		case 4:
+			id := song()
+			op = fmt.Sprintf("DeleteSong(%d)", id)
+			fn = func(s storage.Storage) string {
+				ok, err := s.DeleteSong(id)
+				return result(ok, err)
+			}
+		case 5:
+			id := song()
+			p := storage.Provenance{
+				FilePath:      fmt.Sprintf("/music/%d.mp3", i),
+				Duration:      time.Duration(r.IntN(1000000)) * time.Millisecond,
+				SampleRate:    44100,
+				ContentHash:   fmt.Sprintf("%x", r.Uint64()),
+				HashCount:     r.IntN(1000),
+				ParamsVersion: "params",
+			}
+			op = fmt.Sprintf("SetProvenance(%d, %+v)", id, p)
+			fn = func(s storage.Storage) string {
+				return result(nil, s.SetProvenance(id, p))
+			}
+		case 6:
+			key, value := sameSettings[r.IntN(len(sameSettings))], fmt.Sprint(i)
+			op = fmt.Sprintf("SetSetting(%q, %q)", key, value)
+			fn = func(s storage.Storage) string {
+				return result(nil, s.SetSetting(key, value))
+			}
+		case 7:
+			start := time.UnixMilli(1700000000000 + int64(i)*60000)
+			v := storage.Verdict{
+				Station: "http://example.com/main.mp3",
+				Title:   fmt.Sprintf("title %d", i),
+				SongID:  song(),
+				Outcome: storage.OutcomeAgreement,
+				Start:   start,
+				End:     start.Add(time.Minute),
+			}
+			op = fmt.Sprintf("StoreVerdict(%+v)", v)
+			fn = func(s storage.Storage) string {
+				id, err := s.StoreVerdict(v)
+				return result(id, err)
+			}
+		case 8:
+			addresses := make([]storage.Address, r.IntN(10))
+			for i := range addresses {
+				addresses[i] = sameAddresses[r.IntN(len(sameAddresses))]
+			}
+			op = fmt.Sprintf("GetCouples(%v)", addresses)
+			fn = func(s storage.Storage) string {
+				couples, err := s.GetCouples(addresses)
+				return result(formatCouples(couples), err)
+			}
+		case 9:
+			id, key := song(), sameKeys[r.IntN(len(sameKeys))]
+			op = fmt.Sprintf("GetSongByID(%d), GetSongByKey(%q)", id, key)
+			fn = func(s storage.Storage) string {
+				byID, ok, err := s.GetSongByID(id)
+				byKey, keyOK, keyErr := s.GetSongByKey(key)
+				return result(fmt.Sprintf("%+v %v", byID, ok), err) + " " + result(fmt.Sprintf("%+v %v", byKey, keyOK), keyErr)
+			}
+		}
+
+		got, want := fn(b), fn(a)
+		if got != want {
+			t.Fatalf("operation %d: %s = %s, want %s", i, op, got, want)
+		}
+
+		// the IDs are the same on both as long as the results are
+		songs, err := a.ListSongs(0, len(sameKeys)*300)
+		if err != nil {
+			t.Fatalf("ListSongs: %v", err)
+		}
+		ids = ids[:0]
+		for _, song := range songs {
+			ids = append(ids, song.ID)
+		}
+	}
+
+	Equal(t, a, b)
+}
+
+// Equal checks that a and b have the same songs, verdicts, settings and
+// fingerprints. Only the settings and fingerprints Same uses are compared,
+// Storage has no way to list them.
+func Equal(t *testing.T, a, b storage.Storage) {
+	t.Helper()
+
+	contents := func(s storage.Storage) string {
+		var out []string
+
+		songs, err := s.ListSongs(0, math.MaxInt32)
+		out = append(out, result(songs, err))
+		verdicts, err := s.ListVerdicts(0, math.MaxInt32)
+		for i, v := range verdicts {
+			// time.Time has a location, only the instant has to be the same
+			verdicts[i].Start, verdicts[i].End = v.Start.UTC(), v.End.UTC()
+		}
+		out = append(out, result(verdicts, err))
+		for _, key := range sameSettings {
+			value, ok, err := s.GetSetting(key)
+			out = append(out, result(fmt.Sprintf("%s=%q %v", key, value, ok), err))
+		}
+		couples, err := s.GetCouples(sameAddresses)
+		out = append(out, result(formatCouples(couples), err))
+		return strings.Join(out, "\n")
+	}
+
+	if got, want := contents(b), contents(a); got != want {
+		t.Errorf("contents differ, got\n%s\nwant\n%s", got, want)
+	}
+}
+
+// result formats the result of an operation, errors only count as an error
+// since every storage words them its own way
+func result(v any, err error) string {
+	if err != nil {
+		return "error"
+	}
+	return fmt.Sprintf("%+v", v)
+}
+
+// formatCouples formats the result of GetCouples with the addresses and
+// couples sorted
+func formatCouples(couples map[storage.Address][]storage.Couple) string {
+	var b strings.Builder
+	for _, address := range slices.Sorted(maps.Keys(couples)) {
+		fmt.Fprintf(&b, "%#x:%v ", address, slices.SortedFunc(slices.Values(couples[address]), compareCouples))
+	}
+	return b.String()
+}